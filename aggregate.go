@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+)
+
+// How long the in-memory store keeps a run after its last report.
+const memRunTTL = time.Hour * 24
+
+// scenarioResult is the latest reported result of a scenario in a run.
+type scenarioResult struct {
+	Status        string `json:"status"` // success|error|quarantined|cancelled|interrupted
+	Data          string `json:"data,omitempty"`
+	Attempts      int    `json:"attempts,omitempty"`
+	PassedOnRetry bool   `json:"passed_on_retry,omitempty"`
+
+	at time.Time // when reported, to merge the runs of a group
+}
+
+// runState is the aggregated state of a run, from its reports.
+type runState struct {
+	RunID      string
+	GroupID    string
+	Total      int                       // from total_scenarios, 0 if unknown
+	Results    map[string]scenarioResult // by scenario
+	Attributes map[string]string         // from the latest report
+}
+
+// done returns true if all of the run's scenarios have reported.
+func (st *runState) done() bool {
+	return st.Total > 0 && len(st.Results) >= st.Total
+}
+
+// failed returns the sorted scenarios that did not succeed, excluding the
+// quarantined ones.
+func (st *runState) failed() []string {
+	var out []string
+	for f, r := range st.Results {
+		if r.Status != "success" && r.Status != "quarantined" {
+			out = append(out, f)
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// quarantined returns the sorted scenarios that failed while quarantined.
+func (st *runState) quarantined() []string {
+	var out []string
+	for f, r := range st.Results {
+		if r.Status == "quarantined" {
+			out = append(out, f)
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// resultStore keeps the per-run scenario results reported by workers.
+type resultStore interface {
+	// Record saves the result of one scenario and returns the run's state.
+	Record(ctx context.Context, r ReportPubsub) (*runState, error)
+
+	// Results returns the state of run runID or, if empty, the merged state of
+	// all the runs of groupID, where the latest result of each scenario wins.
+	// The returned state is empty (no results) if nothing is found.
+	Results(ctx context.Context, runID, groupID string) (*runState, error)
+
+	// MarkCompleted marks the run as completed. Only the first call for a run
+	// returns true, so that a single 'completed' event is published per run.
+	MarkCompleted(ctx context.Context, runID string) (bool, error)
+
+	// FlakeRates returns the retry history of each of scenarios, across the
+	// recorded runs. Scenarios without results are omitted.
+	FlakeRates(ctx context.Context, scenarios []string) (map[string]flakeStat, error)
+}
+
+// How far back spannerResultStore looks for FlakeRates.
+const flakeWindow = time.Hour * 24 * 30
+
+// reportTotal returns the total_scenarios attribute of r, or 0.
+func reportTotal(r ReportPubsub) int {
+	n, _ := strconv.Atoi(r.Attributes["total_scenarios"])
+	return n
+}
+
+// reportResult returns the scenarioResult of r.
+func reportResult(r ReportPubsub, at time.Time) scenarioResult {
+	attempts, _ := strconv.Atoi(r.Attributes["attempts"])
+	return scenarioResult{
+		Status:        r.Status,
+		Data:          r.Data,
+		Attempts:      attempts,
+		PassedOnRetry: r.Attributes["passed_on_retry"] == "true",
+		at:            at,
+	}
+}
+
+type memRun struct {
+	state     *runState
+	completed bool
+	updated   time.Time
+}
+
+// memResultStore is a resultStore for a single aggregator replica.
+type memResultStore struct {
+	mtx  sync.Mutex
+	runs map[string]*memRun
+}
+
+func newMemResultStore() *memResultStore {
+	return &memResultStore{runs: make(map[string]*memRun)}
+}
+
+func (m *memResultStore) Record(ctx context.Context, r ReportPubsub) (*runState, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for id, run := range m.runs {
+		if time.Since(run.updated) > memRunTTL {
+			delete(m.runs, id)
+		}
+	}
+
+	run, ok := m.runs[r.RunID]
+	if !ok {
+		run = &memRun{state: &runState{RunID: r.RunID, Results: make(map[string]scenarioResult)}}
+		m.runs[r.RunID] = run
+	}
+
+	st := run.state
+	st.GroupID = r.GroupID
+	st.Attributes = r.Attributes
+	if n := reportTotal(r); n > st.Total {
+		st.Total = n
+	}
+
+	run.updated = time.Now()
+	st.Results[r.Scenario] = reportResult(r, run.updated)
+	return copyRunState(st), nil
+}
+
+// copyRunState returns a copy of st that the caller can read outside our lock.
+func copyRunState(st *runState) *runState {
+	cp := *st
+	cp.Results = make(map[string]scenarioResult, len(st.Results))
+	for k, v := range st.Results {
+		cp.Results[k] = v
+	}
+
+	return &cp
+}
+
+func (m *memResultStore) Results(ctx context.Context, runID, groupID string) (*runState, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if runID != "" {
+		if run, ok := m.runs[runID]; ok {
+			return copyRunState(run.state), nil
+		}
+
+		return &runState{RunID: runID, Results: map[string]scenarioResult{}}, nil
+	}
+
+	out := &runState{GroupID: groupID, Results: make(map[string]scenarioResult)}
+	var latest time.Time
+	for _, run := range m.runs {
+		if run.state.GroupID != groupID {
+			continue
+		}
+
+		for f, r := range run.state.Results {
+			if prev, ok := out.Results[f]; !ok || r.at.After(prev.at) {
+				out.Results[f] = r
+			}
+		}
+
+		if run.updated.After(latest) {
+			latest = run.updated
+			out.RunID = run.state.RunID
+			out.Total = run.state.Total
+			out.Attributes = run.state.Attributes
+		}
+	}
+
+	return out, nil
+}
+
+func (m *memResultStore) MarkCompleted(ctx context.Context, runID string) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	run, ok := m.runs[runID]
+	if !ok || run.completed {
+		return false, nil
+	}
+
+	run.completed = true
+	return true, nil
+}
+
+func (m *memResultStore) FlakeRates(ctx context.Context, scenarios []string) (map[string]flakeStat, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	out := make(map[string]flakeStat)
+	for _, run := range m.runs {
+		for _, f := range scenarios {
+			r, ok := run.state.Results[f]
+			if !ok {
+				continue
+			}
+
+			stat := out[f]
+			stat.Runs++
+			if r.PassedOnRetry {
+				stat.Flaky++
+			}
+
+			out[f] = stat
+		}
+	}
+
+	return out, nil
+}
+
+// spannerResultStore is a resultStore shared by all aggregator replicas. The
+// table is expected to be:
+//
+//	CREATE TABLE <table> (
+//	  run_id STRING(MAX) NOT NULL,
+//	  scenario STRING(MAX) NOT NULL, -- empty for the run's 'completed' marker
+//	  group_id STRING(MAX),
+//	  status STRING(MAX),
+//	  total_scenarios INT64,
+//	  data STRING(MAX),
+//	  attributes STRING(MAX), -- JSON
+//	  updated_at TIMESTAMP OPTIONS (allow_commit_timestamp=true),
+//	) PRIMARY KEY (run_id, scenario)
+type spannerResultStore struct {
+	client *spanner.Client
+	table  string
+}
+
+var spannerResultCols = []string{"run_id", "scenario", "group_id", "status", "total_scenarios", "data", "attributes", "updated_at"}
+
+func (s *spannerResultStore) Record(ctx context.Context, r ReportPubsub) (*runState, error) {
+	attrs, _ := json.Marshal(r.Attributes)
+	m := spanner.InsertOrUpdate(s.table, spannerResultCols, []interface{}{
+		r.RunID, r.Scenario, r.GroupID, r.Status, int64(reportTotal(r)), r.Data, string(attrs), spanner.CommitTimestamp,
+	})
+
+	if _, err := s.client.Apply(ctx, []*spanner.Mutation{m}); err != nil {
+		return nil, err
+	}
+
+	return s.Results(ctx, r.RunID, "")
+}
+
+func (s *spannerResultStore) Results(ctx context.Context, runID, groupID string) (*runState, error) {
+	st := &runState{RunID: runID, GroupID: groupID, Results: make(map[string]scenarioResult)}
+	where, params := "run_id = @id", map[string]interface{}{"id": runID}
+	if runID == "" {
+		where, params = "group_id = @id", map[string]interface{}{"id": groupID}
+	}
+
+	// Ordered, so the latest result of each scenario (and run) wins.
+	stmt := spanner.Statement{
+		SQL: fmt.Sprintf(`SELECT run_id, scenario, group_id, status, total_scenarios, data, attributes
+FROM %s WHERE %s AND scenario != '' ORDER BY updated_at`, s.table, where),
+		Params: params,
+	}
+
+	err := s.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var id, scenario, groupID, status, data, attrs spanner.NullString
+		var total spanner.NullInt64
+		if err := row.Columns(&id, &scenario, &groupID, &status, &total, &data, &attrs); err != nil {
+			return err
+		}
+
+		if id.StringVal != st.RunID {
+			st.RunID, st.Total = id.StringVal, 0 // a later run of the group
+		}
+
+		st.GroupID = groupID.StringVal
+		if int(total.Int64) > st.Total {
+			st.Total = int(total.Int64)
+		}
+
+		var attributes map[string]string
+		json.Unmarshal([]byte(attrs.StringVal), &attributes)
+		st.Results[scenario.StringVal] = reportResult(ReportPubsub{
+			Status:     status.StringVal,
+			Data:       data.StringVal,
+			Attributes: attributes,
+		}, time.Time{})
+
+		json.Unmarshal([]byte(attrs.StringVal), &st.Attributes) // merged across rows
+		return nil
+	})
+
+	return st, err
+}
+
+func (s *spannerResultStore) MarkCompleted(ctx context.Context, runID string) (bool, error) {
+	var first bool
+	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, tx *spanner.ReadWriteTransaction) error {
+		first = false
+		_, err := tx.ReadRow(ctx, s.table, spanner.Key{runID, ""}, []string{"run_id"})
+		switch {
+		case err == nil:
+			return nil // already completed
+		case spanner.ErrCode(err) != codes.NotFound:
+			return err
+		}
+
+		first = true
+		return tx.BufferWrite([]*spanner.Mutation{
+			spanner.Insert(s.table, []string{"run_id", "scenario", "status", "updated_at"},
+				[]interface{}{runID, "", "completed", spanner.CommitTimestamp}),
+		})
+	})
+
+	return first, err
+}
+
+func (s *spannerResultStore) FlakeRates(ctx context.Context, scenarios []string) (map[string]flakeStat, error) {
+	out := make(map[string]flakeStat)
+	stmt := spanner.Statement{
+		SQL: fmt.Sprintf(`SELECT scenario, COUNT(*),
+COUNTIF(JSON_VALUE(attributes, '$.passed_on_retry') = 'true')
+FROM %s WHERE scenario IN UNNEST(@scenarios) AND updated_at > @since
+GROUP BY scenario`, s.table),
+		Params: map[string]interface{}{
+			"scenarios": scenarios,
+			"since":     time.Now().Add(-flakeWindow),
+		},
+	}
+
+	err := s.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var scenario string
+		var runs, flaky int64
+		if err := row.Columns(&scenario, &runs, &flaky); err != nil {
+			return err
+		}
+
+		out[scenario] = flakeStat{Runs: int(runs), Flaky: int(flaky)}
+		return nil
+	})
+
+	return out, err
+}
+
+// publisher is what we need from lspubsub.PubsubPublisher.
+type publisher interface {
+	Publish(key string, data interface{}) error
+}
+
+// aggregator turns the workers' scenario reports into run-level progress: a
+// 'progress' ScenarioProgressMessage per report, then a single 'completed' (or
+// 'cancelled', if any scenario was) message once all scenarios have reported.
+type aggregator struct {
+	store resultStore
+	pub   publisher // progress topic, i.e. --scenario-pubsub
+}
+
+// progressMessage returns a ScenarioProgressMessage for st, with the run-level
+// fields taken from the run's report attributes.
+func progressMessage(st *runState, code string) ScenarioProgressMessage {
+	attr := st.Attributes
+	msg := ScenarioProgressMessage{
+		Code:             code,
+		RunID:            st.RunID,
+		TotalScenarios:   fmt.Sprintf("%d/%d", len(st.Results), st.Total), // done/total
+		TriggerType:      attr["trigger_type"],
+		RerunMode:        attr["rerun_mode"],
+		CommitSHA:        attr["commit_sha"],
+		Repository:       attr["repository"],
+		RunURL:           attr["run_url"],
+		PRNumber:         attr["pr_number"],
+		MissingTestsInPR: attr["missing_tests_in_pr"] == "true",
+		ShouldRunTests:   attr["should_run_tests"] == "true",
+	}
+
+	return msg
+}
+
+// handleReport is the callback for the report subscription.
+func (g *aggregator) handleReport(ctx any, data []byte) error {
+	var r ReportPubsub
+	if err := json.Unmarshal(data, &r); err != nil {
+		log.Printf("aggregator: unmarshal failed: %v", err)
+		return nil // not retryable
+	}
+
+	if r.RunID == "" {
+		return nil // i.e. local runs
+	}
+
+	bctx := context.Background()
+	st, err := g.store.Record(bctx, r)
+	if err != nil {
+		log.Printf("aggregator: record %v failed: %v", r.RunID, err)
+		return err
+	}
+
+	msg := progressMessage(st, "progress")
+	msg.Status = r.Status
+	msg.Scenario = r.Scenario
+	msg.Data = r.Data
+	if err := g.pub.Publish(uuid.NewString(), msg); err != nil {
+		log.Printf("aggregator: publish progress failed: %v", err)
+	}
+
+	if !st.done() {
+		return nil
+	}
+
+	first, err := g.store.MarkCompleted(bctx, r.RunID)
+	if err != nil {
+		log.Printf("aggregator: mark completed %v failed: %v", r.RunID, err)
+		return err
+	}
+
+	if !first {
+		return nil
+	}
+
+	code := "completed"
+	for _, res := range st.Results {
+		if res.Status == "cancelled" {
+			code = "cancelled"
+		}
+	}
+
+	msg = progressMessage(st, code)
+	msg.FailedScenarios = st.failed()
+	msg.FailedCount = int64(len(msg.FailedScenarios))
+	msg.QuarantinedScenarios = st.quarantined()
+	msg.OverallStatus = "success"
+	if msg.FailedCount > 0 {
+		msg.OverallStatus = "failure"
+	}
+
+	var scenarios []string
+	for f := range st.Results {
+		scenarios = append(scenarios, f)
+	}
+
+	stats, err := g.store.FlakeRates(bctx, scenarios)
+	if err != nil {
+		log.Printf("aggregator: flake rates for %v failed: %v", r.RunID, err) // label this run's only
+	}
+
+	msg.FlakyScenarios = flakyLabels(st, stats)
+
+	log.Printf("aggregator: run %v %v, %d/%d failed", st.RunID, code, msg.FailedCount, st.Total)
+	return g.pub.Publish(uuid.NewString(), msg)
+}
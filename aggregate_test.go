@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type fakePublisher struct {
+	msgs []ScenarioProgressMessage
+}
+
+func (p *fakePublisher) Publish(key string, data interface{}) error {
+	b, _ := json.Marshal(data)
+	var msg ScenarioProgressMessage
+	json.Unmarshal(b, &msg)
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func Test__aggregator(t *testing.T) {
+	pub := &fakePublisher{}
+	g := &aggregator{store: newMemResultStore(), pub: pub}
+	report := func(scenario, status string) {
+		b, _ := json.Marshal(ReportPubsub{
+			Scenario: scenario,
+			Status:   status,
+			RunID:    "run1",
+			Attributes: map[string]string{
+				"total_scenarios": "2",
+				"commit_sha":      "abc",
+				"repository":      "org/repo",
+			},
+		})
+
+		if err := g.handleReport(nil, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report("a.yaml", "success")
+	report("b.yaml", "error")
+	report("b.yaml", "error") // redelivery: no second 'completed'
+	var codes []string
+	for _, m := range pub.msgs {
+		codes = append(codes, m.Code)
+	}
+
+	if want := []string{"progress", "progress", "completed", "progress"}; !reflect.DeepEqual(codes, want) {
+		t.Fatalf("expected %v, got %v", want, codes)
+	}
+
+	done := pub.msgs[2]
+	if done.OverallStatus != "failure" || done.FailedCount != 1 || !reflect.DeepEqual(done.FailedScenarios, []string{"b.yaml"}) {
+		t.Fatalf("unexpected completed message: %+v", done)
+	}
+
+	if done.CommitSHA != "abc" || done.Repository != "org/repo" || done.TotalScenarios != "2/2" {
+		t.Fatalf("missing run attributes: %+v", done)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// apiServer is the HTTP control API of the 'run' service (--api-addr), for
+// tools that can't publish to the transport directly. Requests are authorized
+// by a bearer token (--api-token), or a client certificate signed by
+// --api-client-ca (mTLS).
+type apiServer struct {
+	app   *appctx
+	token string
+}
+
+// newAPIServer returns the server for --api-addr, with TLS if --api-tls-cert is
+// set. At least one of --api-token or --api-client-ca is required.
+func newAPIServer(app *appctx) (*http.Server, error) {
+	if apitoken == "" && apiclientca == "" {
+		return nil, fmt.Errorf("--api-addr needs --api-token or --api-client-ca")
+	}
+
+	a := &apiServer{app: app, token: apitoken}
+	srv := &http.Server{
+		Addr:              apiaddr,
+		Handler:           a.handler(),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	if apitlscert == "" && apitlskey == "" {
+		if apiclientca != "" {
+			return nil, fmt.Errorf("--api-client-ca needs --api-tls-cert and --api-tls-key")
+		}
+
+		return srv, nil
+	}
+
+	if apitlscert == "" || apitlskey == "" {
+		return nil, fmt.Errorf("--api-tls-cert and --api-tls-key go together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(apitlscert, apitlskey)
+	if err != nil {
+		return nil, errors.Wrap(err, "load --api-tls-cert failed")
+	}
+
+	srv.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if apiclientca != "" {
+		b, err := os.ReadFile(apiclientca)
+		if err != nil {
+			return nil, errors.Wrap(err, "read --api-client-ca failed")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in --api-client-ca %v", apiclientca)
+		}
+
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if apitoken != "" {
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven // or the token
+		}
+	}
+
+	return srv, nil
+}
+
+// serveAPI serves srv until ctx is done, then waits up to --shutdown-grace for
+// the requests in flight.
+func serveAPI(ctx context.Context, srv *http.Server) {
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), shutdowngrace)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+
+	log.Printf("serving the control API on %v (tls=%v)", srv.Addr, srv.TLSConfig != nil)
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("control API on %v failed: %v", srv.Addr, err)
+	}
+}
+
+func (a *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /runs", a.startRun)
+	mux.HandleFunc("GET /runs/{id}", a.getRun)
+	mux.HandleFunc("POST /runs/{id}/cancel", a.cancelRun)
+	mux.HandleFunc("GET /scenarios", a.listScenarios)
+	mux.HandleFunc("POST /scenarios/run", a.runScenarioSync)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oops"`)
+			apiError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized returns true if r has a verified client certificate, or the
+// bearer token.
+func (a *apiServer) authorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	if a.token == "" {
+		return false
+	}
+
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(a.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJSON(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// decodeBody decodes the JSON body of r into v. An empty body is fine.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Wrap(err, "invalid body")
+	}
+
+	return nil
+}
+
+// apiRunRequest is the body of POST /runs.
+type apiRunRequest struct {
+	ID       string                 `json:"id,omitempty"`       // generated if empty
+	GroupID  string                 `json:"group_id,omitempty"` // defaults to id
+	Tags     []string               `json:"tags,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	All      bool                   `json:"all,omitempty"` // start_all
+}
+
+// startRun publishes a 'start' (or 'start_all') command, like 'oops trigger'.
+func (a *apiServer) startRun(w http.ResponseWriter, r *http.Request) {
+	var req apiRunRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if _, err := parseTags(req.Tags); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if req.Metadata == nil {
+		req.Metadata = make(map[string]interface{})
+	}
+
+	// The service expects a trigger_type for its Slack notification.
+	if _, ok := req.Metadata["trigger_type"].(string); !ok {
+		req.Metadata["trigger_type"] = "api"
+	}
+
+	if req.ID == "" {
+		req.ID = uuid.NewString()
+	}
+
+	if req.GroupID == "" {
+		req.GroupID = req.ID
+	}
+
+	c := cmd{Code: "start", ID: req.ID, GroupID: req.GroupID, Tags: req.Tags, Metadata: req.Metadata}
+	if req.All {
+		c.Code = "start_all"
+	}
+
+	if err := a.app.transport.PublishCommand(c); err != nil {
+		apiError(w, http.StatusBadGateway, "publish failed: %v", err)
+		return
+	}
+
+	log.Printf("api: %v run_id=%v group_id=%v tags=%v", c.Code, c.ID, c.GroupID, c.Tags)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": c.ID, "group_id": c.GroupID, "code": c.Code})
+}
+
+// apiRunState is the response of GET /runs/{id}.
+type apiRunState struct {
+	RunID       string                    `json:"run_id"`
+	GroupID     string                    `json:"group_id,omitempty"`
+	Total       int                       `json:"total"` // 0 if unknown
+	Reported    int                       `json:"reported"`
+	Done        bool                      `json:"done"`
+	Failed      []string                  `json:"failed"`
+	Results     map[string]scenarioResult `json:"results"`
+	Attributes  map[string]string         `json:"attributes,omitempty"`
+	Quarantined []string                  `json:"quarantined,omitempty"`
+}
+
+// getRun returns the progress and results of a run, from the aggregator's
+// --result-store.
+func (a *apiServer) getRun(w http.ResponseWriter, r *http.Request) {
+	if a.app.results == nil {
+		apiError(w, http.StatusNotImplemented, "no --result-store")
+		return
+	}
+
+	id := r.PathValue("id")
+	st, err := a.app.results.Results(r.Context(), id, "")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "results failed: %v", err)
+		return
+	}
+
+	if len(st.Results) == 0 {
+		apiError(w, http.StatusNotFound, "no results for run %v (needs --aggregate)", id)
+		return
+	}
+
+	out := apiRunState{
+		RunID:      id,
+		GroupID:    st.GroupID,
+		Total:      st.Total,
+		Reported:   len(st.Results),
+		Done:       st.done(),
+		Failed:     st.failed(),
+		Results:    st.Results,
+		Attributes: st.Attributes,
+	}
+
+	for f, res := range st.Results {
+		if res.Status == "quarantined" {
+			out.Quarantined = append(out.Quarantined, f)
+		}
+	}
+
+	sort.Strings(out.Quarantined)
+	if out.Failed == nil {
+		out.Failed = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// cancelRun publishes a 'cancel' command for the run, like 'oops trigger --code
+// cancel'. The body can have a commit_sha and a reason.
+func (a *apiServer) cancelRun(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CommitSha string `json:"commit_sha,omitempty"`
+		Reason    string `json:"reason,omitempty"`
+	}
+
+	if err := decodeBody(w, r, &req); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	metadata := map[string]interface{}{"reason": req.Reason}
+	if req.CommitSha != "" {
+		metadata["commit_sha"] = req.CommitSha
+	}
+
+	c := cmd{Code: "cancel", ID: r.PathValue("id"), Metadata: metadata}
+	if err := a.app.transport.PublishCommand(c); err != nil {
+		apiError(w, http.StatusBadGateway, "publish failed: %v", err)
+		return
+	}
+
+	log.Printf("api: cancel run_id=%v commit_sha=%v", c.ID, req.CommitSha)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": c.ID, "code": c.Code})
+}
+
+// apiScenario is a discovered scenario, in GET /scenarios.
+type apiScenario struct {
+	File        string            `json:"file"` // relative to --dir, if under it
+	Tags        map[string]string `json:"tags,omitempty"`
+	Maintainers []string          `json:"maintainers,omitempty"`
+	Variants    []string          `json:"variants,omitempty"` // matrix/data expansion
+}
+
+// discoveredScenarios returns the scenario files of --dir and --scenarios, like
+// combineFilesAndDir, but without exiting if there are none.
+func discoveredScenarios() []string {
+	tmp := make(map[string]struct{})
+	for _, v := range files {
+		if f, err := filepath.Abs(v); err == nil {
+			tmp[f] = struct{}{}
+		}
+	}
+
+	for _, f := range findScenarioFiles(dir) {
+		tmp[f] = struct{}{}
+	}
+
+	var out []string
+	for f := range tmp {
+		out = append(out, f)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// relDir returns f relative to --dir, if under it, else f.
+func relDir(f string) string {
+	root, _ := filepath.Abs(dir)
+	if rel, err := filepath.Rel(root, f); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+
+	return f
+}
+
+// listScenarios returns the discovered scenarios and their tags, filtered by
+// the 'tags' query parameters, if any (same syntax as --tags).
+func (a *apiServer) listScenarios(w http.ResponseWriter, r *http.Request) {
+	filters := r.URL.Query()["tags"]
+	if _, err := parseTags(filters); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	out := []apiScenario{}
+	for _, f := range discoveredScenarios() {
+		yml, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		var s Scenario
+		if err := yaml.Unmarshal(yml, &s); err != nil {
+			log.Printf("api: %v: %v", f, err)
+			continue
+		}
+
+		if !isAllowedWithTags(&s, filters) {
+			continue
+		}
+
+		sc := apiScenario{File: relDir(f), Tags: s.Tags, Maintainers: s.Maintainers}
+		if vs, err := scenarioVariants(f); err == nil && len(vs) > 1 {
+			for _, v := range vs {
+				sc.Variants = append(sc.Variants, relDir(v.Name))
+			}
+		}
+
+		out = append(out, sc)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"scenarios": out})
+}
+
+// apiScenarioRunRequest is the body of POST /scenarios/run.
+type apiScenarioRunRequest struct {
+	Scenario string                 `json:"scenario"`         // as in GET /scenarios, a file or a variant
+	RunID    string                 `json:"run_id,omitempty"` // if set, results are reported as for a run
+	GroupID  string                 `json:"group_id,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// runScenarioSync runs a discovered scenario (or one of its variants) on this pod,
+// after the command being processed, if any, and returns its results. It's
+// interrupted if the client goes away.
+func (a *apiServer) runScenarioSync(w http.ResponseWriter, r *http.Request) {
+	var req apiScenarioRunRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	name := req.Scenario
+	file, _ := splitVariant(name)
+	if !filepath.IsAbs(file) {
+		root, _ := filepath.Abs(dir)
+		name = filepath.Join(root, name)
+		file = filepath.Join(root, file)
+	}
+
+	var found bool
+	for _, f := range discoveredScenarios() {
+		found = found || f == file
+	}
+
+	if !found {
+		apiError(w, http.StatusNotFound, "no such scenario %q", req.Scenario)
+		return
+	}
+
+	in := &doScenarioInput{
+		app:           a.app,
+		ScenarioFiles: []string{name},
+		Verbose:       verbose,
+		Metadata:      req.Metadata,
+		RunID:         req.RunID,
+		GroupID:       req.GroupID,
+	}
+
+	if in.Metadata == nil {
+		in.Metadata = make(map[string]interface{})
+	}
+
+	if req.RunID != "" {
+		in.ReportSlack, in.ReportPubsub = repslack, reppubsub
+	}
+
+	var mtx sync.Mutex
+	results := make(map[string]string)
+	in.OnScenarioDone = func(scenario, status string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		results[relDir(scenario)] = status
+	}
+
+	// Like process: a pod runs one thing at a time.
+	a.app.mtx.Lock()
+	defer a.app.mtx.Unlock()
+	if err := r.Context().Err(); err != nil {
+		return // client gone while waiting
+	}
+
+	log.Printf("api: run scenario %v run_id=%v", req.Scenario, req.RunID)
+	start := time.Now()
+	doScenario(r.Context(), in)
+
+	status := "success"
+	if len(results) == 0 {
+		status = "not_run" // cancelled, or not allowed by --tags
+	}
+
+	for _, s := range results {
+		if s == "error" {
+			status = "error"
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"scenario": req.Scenario,
+		"status":   status,
+		"results":  results,
+		"duration": time.Since(start).String(),
+	})
+}
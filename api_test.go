@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test__apiServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer backend.Close()
+	root := t.TempDir()
+	writeTestFile(t, root, "billing/scenarios/ok.yaml", "tags: {env: dev}\nrun:\n- http: {method: GET, url: "+backend.URL+", asserts: {status_code: 200}}\n")
+	writeTestFile(t, root, "billing/scenarios/fail.yaml", "tags: {env: prod}\nrun:\n- http: {method: GET, url: "+backend.URL+"/fail, asserts: {status_code: 200}}\n")
+	writeTestFile(t, root, "billing/scenarios/matrix.yaml", "tags: {env: dev}\nmatrix: {region: [us, jp]}\n")
+
+	defer func(d string, f []string) { dir, files = d, f }(dir, files)
+	dir, files = root, nil
+	tr := newMemTransport()
+	app := &appctx{
+		ctx:       context.Background(),
+		mtx:       &sync.Mutex{},
+		transport: tr,
+		suites:    newSuiteCache(),
+		results:   newMemResultStore(),
+	}
+
+	ts := httptest.NewServer((&apiServer{app: app, token: "secret"}).handler())
+	defer ts.Close()
+	do := func(method, path, token, body string, want int) map[string]interface{} {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("%v %v: got %v, want %v: %s", method, path, resp.StatusCode, want, b)
+		}
+
+		var v map[string]interface{}
+		json.Unmarshal(b, &v)
+		return v
+	}
+
+	do("GET", "/scenarios", "", "", http.StatusUnauthorized)
+	do("GET", "/scenarios", "wrong", "", http.StatusUnauthorized)
+
+	// Discovered scenarios, with tags and variants.
+	v := do("GET", "/scenarios?tags=env=dev", "secret", "", http.StatusOK)
+	scenarios := v["scenarios"].([]interface{})
+	if len(scenarios) != 2 {
+		t.Fatalf("expected 2 scenarios, got %v", scenarios)
+	}
+
+	m := scenarios[0].(map[string]interface{})
+	if m["file"] != "billing/scenarios/matrix.yaml" || len(m["variants"].([]interface{})) != 2 {
+		t.Fatalf("unexpected scenario %v", m)
+	}
+
+	// A start command, as from 'oops trigger'.
+	v = do("POST", "/runs", "secret", `{"tags":["env=dev"],"metadata":{"commit_sha":"abc"}}`, http.StatusAccepted)
+	b, ok := tr.next(tr.topic(memCommands))
+	if !ok {
+		t.Fatal("no command published")
+	}
+
+	var c cmd
+	json.Unmarshal(b, &c)
+	if c.Code != "start" || c.ID != v["id"] || c.GroupID != c.ID || c.Metadata["trigger_type"] != "api" {
+		t.Fatalf("unexpected command %+v", c)
+	}
+
+	do("POST", "/runs", "secret", `{"tags":["env=("]}`, http.StatusBadRequest)
+
+	do("POST", "/runs/run1/cancel", "secret", `{"commit_sha":"abc","reason":"manual"}`, http.StatusAccepted)
+	b, _ = tr.next(tr.topic(memCommands))
+	c = cmd{}
+	json.Unmarshal(b, &c)
+	if c.Code != "cancel" || c.ID != "run1" || c.Metadata["commit_sha"] != "abc" {
+		t.Fatalf("unexpected command %+v", c)
+	}
+
+	// Progress and results, from the result store.
+	do("GET", "/runs/run1", "secret", "", http.StatusNotFound)
+	app.results.Record(context.Background(), ReportPubsub{
+		Scenario:   "ok.yaml",
+		Status:     "error",
+		RunID:      "run1",
+		Attributes: map[string]string{"total_scenarios": "2"},
+	})
+
+	v = do("GET", "/runs/run1", "secret", "", http.StatusOK)
+	if v["total"].(float64) != 2 || v["reported"].(float64) != 1 || v["done"] != false || len(v["failed"].([]interface{})) != 1 {
+		t.Fatalf("unexpected run %v", v)
+	}
+
+	// Synchronous runs on this pod.
+	v = do("POST", "/scenarios/run", "secret", `{"scenario":"billing/scenarios/ok.yaml"}`, http.StatusOK)
+	if v["status"] != "success" {
+		t.Fatalf("unexpected result %v", v)
+	}
+
+	v = do("POST", "/scenarios/run", "secret", `{"scenario":"billing/scenarios/fail.yaml"}`, http.StatusOK)
+	if v["status"] != "error" {
+		t.Fatalf("unexpected result %v", v)
+	}
+
+	do("POST", "/scenarios/run", "secret", `{"scenario":"../../etc/passwd"}`, http.StatusNotFound)
+	if len(tr.Reports()) != 0 {
+		t.Fatalf("expected no reports without a run_id, got %v", tr.Reports())
+	}
+}
+
+// testClientCert returns a CA, and a client certificate signed by it.
+func testClientCert(t *testing.T) (*x509.Certificate, tls.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "oops-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, _ := x509.ParseCertificate(der)
+	ckey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ctmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "oops-test-client"},
+		NotBefore:    tmpl.NotBefore,
+		NotAfter:     tmpl.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	cder, err := x509.CreateCertificate(rand.Reader, ctmpl, ca, &ckey.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca, tls.Certificate{Certificate: [][]byte{cder}, PrivateKey: ckey}
+}
+
+func Test__apiServerMTLS(t *testing.T) {
+	ca, cert := testClientCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ts := httptest.NewUnstartedServer((&apiServer{}).handler())
+	ts.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	for _, tc := range []struct {
+		certs []tls.Certificate
+		want  int
+	}{
+		{[]tls.Certificate{cert}, http.StatusOK},
+		{nil, http.StatusUnauthorized}, // and no token configured
+	} {
+		// A new transport per case: no connection or TLS session is reused.
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: tc.certs}}
+		client := &http.Client{Transport: tr}
+		resp, err := client.Get(ts.URL + "/scenarios")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("%v client certificates: got %v, want %v", len(tc.certs), resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func Test__newAPIServer(t *testing.T) {
+	defer func(tok, ca, cert, key string) {
+		apitoken, apiclientca, apitlscert, apitlskey = tok, ca, cert, key
+	}(apitoken, apiclientca, apitlscert, apitlskey)
+
+	for _, tc := range []struct {
+		token, ca, cert, key string
+		err                  string // expected in the error, if any
+	}{
+		{"", "", "", "", "--api-token or --api-client-ca"}, // no auth
+		{"secret", "", "", "", ""},
+		{"", "/tmp/ca.pem", "", "", "--api-client-ca needs"}, // mTLS needs a server certificate
+		{"secret", "", "/tmp/cert.pem", "", "--api-tls-cert and --api-tls-key"},
+		{"secret", "", "", "/tmp/key.pem", "--api-tls-cert and --api-tls-key"},
+		{"secret", "", "/nonexistent.pem", "/nonexistent.pem", "load --api-tls-cert"},
+	} {
+		apitoken, apiclientca, apitlscert, apitlskey = tc.token, tc.ca, tc.cert, tc.key
+		_, err := newAPIServer(&appctx{})
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%+v: got %v", tc, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%+v: got %v, want %q", tc, err, tc.err)
+		}
+	}
+}
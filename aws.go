@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+)
+
+// How long an SQS receive waits for a message.
+const sqsWaitSeconds = 20
+
+// awsSession returns a session for --region. Credentials are --aws-key and
+// --aws-secret if both are set, else the SDK's default chain: environment, shared
+// config/credentials (--aws-profile), web identity token (i.e. IRSA on EKS), then
+// ECS/EC2 metadata. With --aws-rolearn, that role is assumed on top.
+func awsSession() (*session.Session, error) {
+	cnf := aws.Config{}
+	if region != "" {
+		cnf.Region = aws.String(region)
+	}
+
+	if key != "" && secret != "" {
+		cnf.Credentials = credentials.NewStaticCredentials(key, secret, "")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            cnf,
+		Profile:           awsprofile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "aws session failed")
+	}
+
+	if rolearn != "" {
+		sess = sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, rolearn)})
+	}
+
+	return sess, nil
+}
+
+// awsCredentialSource describes where awsSession gets its credentials, for logs.
+func awsCredentialSource() string {
+	src := "default chain"
+	if key != "" && secret != "" {
+		src = "static (--aws-key)"
+	}
+
+	if awsprofile != "" {
+		src += fmt.Sprintf(", profile=%v", awsprofile)
+	}
+
+	if rolearn != "" {
+		src += fmt.Sprintf(", assume %v", rolearn)
+	}
+
+	return src
+}
+
+// snsTopic returns the ARN of topic, created if needed.
+func snsTopic(svc snsiface.SNSAPI, topic string) (*string, error) {
+	res, err := svc.CreateTopic(&sns.CreateTopicInput{Name: aws.String(topic)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "create topic %v failed", topic)
+	}
+
+	return res.TopicArn, nil
+}
+
+// sqsSubscribe subscribes queue (created if needed, with a policy allowing the
+// topic to send to it) to topicArn, with raw delivery, and returns the
+// subscription ARN.
+func sqsSubscribe(snsSvc snsiface.SNSAPI, sqsSvc sqsiface.SQSAPI, topicArn *string, queue string) (*string, error) {
+	q, err := sqsSvc.CreateQueue(&sqs.CreateQueueInput{QueueName: aws.String(queue)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "create queue %v failed", queue)
+	}
+
+	attrs, err := sqsSvc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       q.QueueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "get queue %v attributes failed", queue)
+	}
+
+	qarn := aws.StringValue(attrs.Attributes[sqs.QueueAttributeNameQueueArn])
+	_, err = sqsSvc.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		QueueUrl: q.QueueUrl,
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNamePolicy: aws.String(sqsPolicy(qarn, aws.StringValue(topicArn))),
+		},
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "set queue %v policy failed", queue)
+	}
+
+	sub, err := snsSvc.Subscribe(&sns.SubscribeInput{
+		TopicArn:   topicArn,
+		Protocol:   aws.String("sqs"),
+		Endpoint:   aws.String(qarn),
+		Attributes: map[string]*string{"RawMessageDelivery": aws.String("true")},
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "subscribe %v to %v failed", queue, aws.StringValue(topicArn))
+	}
+
+	return sub.SubscriptionArn, nil
+}
+
+// sqsPolicy returns a queue policy allowing topicArn to send to queueArn.
+func sqsPolicy(queueArn, topicArn string) string {
+	return `{
+  "Version": "2012-10-17",
+  "Statement": [{
+    "Effect": "Allow",
+    "Principal": {"Service": "sns.amazonaws.com"},
+    "Action": "sqs:SendMessage",
+    "Resource": "` + queueArn + `",
+    "Condition": {"ArnEquals": {"aws:SourceArn": "` + topicArn + `"}}
+  }]
+}`
+}
+
+// sqsDelete deletes queue.
+func sqsDelete(svc sqsiface.SQSAPI, queue string) error {
+	q, err := svc.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: q.QueueUrl})
+	return err
+}
+
+// sqsListen calls handler for each message of queue, one at a time, until ctx is
+// done. The message's visibility timeout is extended while handler runs, and the
+// message is deleted afterwards, even if handler failed (the error is logged).
+func sqsListen(ctx context.Context, svc sqsiface.SQSAPI, queue string, handler func(data []byte) error) error {
+	q, err := svc.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if err != nil {
+		return errors.Wrapf(err, "get queue %v failed", queue)
+	}
+
+	attrs, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       q.QueueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, "get queue %v attributes failed", queue)
+	}
+
+	vis, _ := strconv.Atoi(aws.StringValue(attrs.Attributes[sqs.QueueAttributeNameVisibilityTimeout]))
+	if vis < 3 {
+		vis = 30 // SQS default
+	}
+
+	log.Printf("listening on %v, visibility=%vs", queue, vis)
+	for ctx.Err() == nil {
+		res, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            q.QueueUrl,
+			MaxNumberOfMessages: aws.Int64(1),
+			WaitTimeSeconds:     aws.Int64(sqsWaitSeconds),
+		})
+
+		if err != nil {
+			if ctx.Err() != nil || isAWSCanceled(err) {
+				return nil
+			}
+
+			log.Printf("sqs: receive %v failed: %v", queue, err)
+			time.Sleep(time.Second * 5)
+			continue
+		}
+
+		for _, m := range res.Messages {
+			sqsHandle(svc, q.QueueUrl, m, vis, handler)
+		}
+	}
+
+	return nil
+}
+
+func isAWSCanceled(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == request.CanceledErrorCode
+}
+
+// sqsHandle runs handler on m, extending its visibility timeout until done, then
+// deletes it.
+func sqsHandle(svc sqsiface.SQSAPI, url *string, m *sqs.Message, vis int, handler func(data []byte) error) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(vis) * time.Second * 2 / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          url,
+					ReceiptHandle:     m.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(int64(vis)),
+				})
+
+				if err != nil {
+					log.Printf("sqs: extend visibility failed: %v", err)
+					if strings.Contains(strings.ToLower(err.Error()), "beyond the limit") {
+						return // max 12h total
+					}
+				}
+			}
+		}
+	}()
+
+	err := handler([]byte(aws.StringValue(m.Body)))
+	close(done)
+	if err != nil {
+		log.Printf("sqs: handler failed: %v", err)
+	}
+
+	_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: url, ReceiptHandle: m.ReceiptHandle})
+	if err != nil {
+		log.Printf("sqs: delete message failed: %v", err)
+	}
+}
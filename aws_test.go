@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+func Test__awsSession(t *testing.T) {
+	defer func(k, s, r, p string) { key, secret, rolearn, awsprofile = k, s, r, p }(key, secret, rolearn, awsprofile)
+	t.Setenv("AWS_ACCESS_KEY_ID", "envkey")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+	region, rolearn, awsprofile = "us-east-1", "", ""
+
+	for _, tc := range []struct {
+		key, secret string
+		want        string
+	}{
+		{"static", "s", "static"},
+		{"", "", "envkey"}, // default chain, from env
+		{"static", "", "envkey"},
+	} {
+		key, secret = tc.key, tc.secret
+		sess, err := awsSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := sess.Config.Credentials.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.AccessKeyID != tc.want {
+			t.Errorf("key=%q secret=%q: got %v, want %v", tc.key, tc.secret, v.AccessKeyID, tc.want)
+		}
+	}
+
+	// The role is assumed on top, not instead.
+	key, secret, rolearn = "", "", "arn:aws:iam::123456789012:role/oops"
+	sess, err := awsSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := awsCredentialSource(); got != "default chain, assume "+rolearn {
+		t.Errorf("unexpected source %q", got)
+	}
+
+	if sess.Config.Credentials == nil {
+		t.Fatal("no credentials")
+	}
+}
+
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	mtx     sync.Mutex
+	queue   []*sqs.Message
+	deleted []string
+}
+
+func (f *fakeSQS) GetQueueUrl(in *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs/" + *in.QueueName)}, nil
+}
+
+func (f *fakeSQS) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameQueueArn:          aws.String("arn:aws:sqs:us-east-1:1:q"),
+		sqs.QueueAttributeNameVisibilityTimeout: aws.String("30"),
+	}}, nil
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if len(f.queue) == 0 {
+		return &sqs.ReceiveMessageOutput{}, ctx.Err()
+	}
+
+	m := f.queue[0]
+	f.queue = f.queue[1:]
+	return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{m}}, nil
+}
+
+func (f *fakeSQS) DeleteMessage(in *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.deleted = append(f.deleted, *in.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func Test__sqsListen(t *testing.T) {
+	svc := &fakeSQS{}
+	for i, body := range []string{`{"code":"process","id":"run1"}`, `{"code":"process","id":"run2"}`} {
+		svc.queue = append(svc.queue, &sqs.Message{
+			Body:          aws.String(body),
+			ReceiptHandle: aws.String(fmt.Sprintf("r%d", i)),
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []string
+	err := sqsListen(ctx, svc, "oops", func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		got = append(got, c.ID)
+		if len(got) == 2 {
+			cancel()
+			return fmt.Errorf("failed") // still deleted
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[0] != "run1" || got[1] != "run2" {
+		t.Fatalf("unexpected messages %v", got)
+	}
+
+	if len(svc.deleted) != 2 {
+		t.Fatalf("expected 2 deletes, got %v", svc.deleted)
+	}
+}
+
+func Test__sqsPolicy(t *testing.T) {
+	var p struct {
+		Statement []struct {
+			Resource  string
+			Condition map[string]map[string]string
+		}
+	}
+
+	if err := json.Unmarshal([]byte(sqsPolicy("arn:q", "arn:t")), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Statement[0].Resource != "arn:q" || p.Statement[0].Condition["ArnEquals"]["aws:SourceArn"] != "arn:t" {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// bodyDigest holds the size and checksums of a response body.
+type bodyDigest struct {
+	Size   int64
+	SHA256 string
+	MD5    string
+}
+
+// check compares d against the checksum/size values in a, if set.
+func (d *bodyDigest) check(a *Asserts) []error {
+	var errs []error
+	if a.Size > 0 && a.Size != d.Size {
+		errs = append(errs, fmt.Errorf("size: got %d, want %d", d.Size, a.Size))
+	}
+
+	if a.SHA256 != "" && !strings.EqualFold(a.SHA256, d.SHA256) {
+		errs = append(errs, fmt.Errorf("sha256: got %v, want %v", d.SHA256, a.SHA256))
+	}
+
+	if a.MD5 != "" && !strings.EqualFold(a.MD5, d.MD5) {
+		errs = append(errs, fmt.Errorf("md5: got %v, want %v", d.MD5, a.MD5))
+	}
+
+	return errs
+}
+
+// digestBytes computes the digest of an in-memory body.
+func digestBytes(b []byte) *bodyDigest {
+	s256 := sha256.Sum256(b)
+	m5 := md5.Sum(b)
+	return &bodyDigest{
+		Size:   int64(len(b)),
+		SHA256: hex.EncodeToString(s256[:]),
+		MD5:    hex.EncodeToString(m5[:]),
+	}
+}
+
+// streamBody copies r to file (discarded if empty) without buffering the whole
+// body in memory, computing its size and checksums on the fly.
+func streamBody(r io.ReadCloser, file string) (*bodyDigest, error) {
+	defer r.Close()
+	var w io.Writer = io.Discard
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+		w = f
+	}
+
+	s256 := sha256.New()
+	m5 := md5.New()
+	n, err := io.Copy(io.MultiWriter(w, s256, m5), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bodyDigest{
+		Size:   n,
+		SHA256: hex.EncodeToString(s256.Sum(nil)),
+		MD5:    hex.EncodeToString(m5.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test__streamBody(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	d, err := streamBody(io.NopCloser(strings.NewReader("hello")), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := os.ReadFile(out)
+	if string(b) != "hello" {
+		t.Fatalf("unexpected file contents: %q", b)
+	}
+
+	want := digestBytes([]byte("hello"))
+	if *d != *want {
+		t.Fatalf("got %+v, want %+v", d, want)
+	}
+
+	errs := d.check(&Asserts{
+		Size:   5,
+		SHA256: "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824",
+		MD5:    "5d41402abc4b2a76b9719d911017c592",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if errs := d.check(&Asserts{Size: 6, MD5: "x"}); len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+}
+
+func Test__runHTTPStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"oops"}`))
+	}))
+
+	defer ts.Close()
+	out := filepath.Join(t.TempDir(), "out.json")
+	s := Scenario{}
+	s.me = &s
+	s.runHTTP(0, filepath.Join(t.TempDir(), "run"), &RunHTTP{
+		Method:      http.MethodGet,
+		URL:         ts.URL + "/file",
+		ResponseOut: out,
+		Stream:      true,
+		Asserts: &Asserts{
+			Code:         http.StatusOK,
+			ContentType:  "application/json",
+			ValidateJSON: `{"required":["name"]}`,
+			Size:         15,
+		},
+	})
+
+	if len(s.errs) > 0 {
+		t.Fatal(s.errs)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// CancelStore keeps the cancelled runs. A run is cancelled by its run ID, or by
+// its commit SHA (i.e. all the runs of a closed PR).
+type CancelStore interface {
+	// Cancelled returns true if runID or commitSha (either may be empty) is
+	// cancelled.
+	Cancelled(ctx context.Context, runID, commitSha string) (bool, error)
+
+	// Cancel records the cancellation of runID and/or commitSha.
+	Cancel(ctx context.Context, runID, commitSha, reason string) error
+}
+
+// newCancelStore returns the CancelStore selected by --cancel-store, or nil if
+// none is set. Without --cancel-store, the Spanner store is used if
+// --spanner-cancel-table is set, as before.
+func newCancelStore(client *spanner.Client) (CancelStore, error) {
+	store := cancelstore
+	if store == "" && spannercanceltable != "" && client != nil {
+		store = "spanner"
+	}
+
+	switch store {
+	case "":
+		return nil, nil
+	case "spanner":
+		if client == nil || spannercanceltable == "" {
+			return nil, fmt.Errorf("--cancel-store=spanner needs --spanner-db and --spanner-cancel-table")
+		}
+
+		return &spannerCancelStore{client: client, table: spannercanceltable}, nil
+	}
+
+	if cancelurl == "" {
+		return nil, fmt.Errorf("--cancel-store=%v needs --cancel-url", store)
+	}
+
+	switch store {
+	case "postgres":
+		s, err := newPostgresCancelStore(cancelurl, canceltable)
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	case "redis":
+		opts, err := redis.ParseURL(cancelurl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "redis url %v", cancelurl)
+		}
+
+		return &redisCancelStore{client: redis.NewClient(opts)}, nil
+	case "http":
+		return &httpCancelStore{url: cancelurl, client: &http.Client{Timeout: time.Second * 10}}, nil
+	case "file":
+		return &fileCancelStore{path: cancelurl}, nil
+	default:
+		return nil, fmt.Errorf("unknown --cancel-store %q, expecting spanner, postgres, redis, http or file", store)
+	}
+}
+
+// spannerCancelStore uses --spanner-cancel-table, where cancelled runs have
+// status 'closed'. The table is shared with the systems that track the runs (i.e.
+// the PR workflows), and is expected to have at least:
+//
+//	CREATE TABLE oops_runs (
+//	  run_id     STRING(MAX) NOT NULL,
+//	  commit_sha STRING(MAX),
+//	  status     STRING(MAX),
+//	  ...        -- any other column must be nullable, or have a default
+//	) PRIMARY KEY (run_id)
+type spannerCancelStore struct {
+	client *spanner.Client
+	table  string
+}
+
+func (s *spannerCancelStore) Cancelled(ctx context.Context, runID, commitSha string) (bool, error) {
+	var where []string
+	params := make(map[string]interface{})
+	if runID != "" {
+		where = append(where, "run_id = @run_id")
+		params["run_id"] = runID
+	}
+
+	if commitSha != "" {
+		where = append(where, "commit_sha = @commit_sha")
+		params["commit_sha"] = commitSha
+	}
+
+	if len(where) == 0 {
+		return false, nil
+	}
+
+	stmt := spanner.Statement{
+		SQL: fmt.Sprintf(`SELECT run_id FROM %s WHERE (%s) AND status = 'closed' LIMIT 1`,
+			s.table, strings.Join(where, " OR ")),
+		Params: params,
+	}
+
+	var found bool
+	err := s.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		found = true
+		return nil
+	})
+
+	return found, err
+}
+
+// Cancel closes the row of runID, inserting it if needed, or without a run ID,
+// the rows of all the runs of commitSha (of which there must be at least one).
+// Only run_id, commit_sha and status are written.
+func (s *spannerCancelStore) Cancel(ctx context.Context, runID, commitSha, reason string) error {
+	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, tx *spanner.ReadWriteTransaction) error {
+		if runID == "" {
+			n, err := tx.Update(ctx, spanner.Statement{
+				SQL:    fmt.Sprintf(`UPDATE %s SET status = 'closed' WHERE commit_sha = @commit_sha`, s.table),
+				Params: map[string]interface{}{"commit_sha": commitSha},
+			})
+
+			if err == nil && n == 0 {
+				err = fmt.Errorf("spanner: no runs of commit_sha %v in %v", commitSha, s.table)
+			}
+
+			return err
+		}
+
+		n, err := tx.Update(ctx, spanner.Statement{
+			SQL:    fmt.Sprintf(`UPDATE %s SET status = 'closed' WHERE run_id = @run_id`, s.table),
+			Params: map[string]interface{}{"run_id": runID},
+		})
+
+		if err != nil || n > 0 {
+			return err
+		}
+
+		_, err = tx.Update(ctx, spanner.Statement{
+			SQL:    fmt.Sprintf(`INSERT INTO %s (run_id, commit_sha, status) VALUES (@run_id, @commit_sha, 'closed')`, s.table),
+			Params: map[string]interface{}{"run_id": runID, "commit_sha": commitSha},
+		})
+
+		return err
+	})
+
+	return err
+}
+
+// postgresCancelStore uses a table (--cancel-table) created if needed as:
+//
+//	CREATE TABLE oops_cancels (
+//	  run_id       TEXT NOT NULL DEFAULT '',
+//	  commit_sha   TEXT NOT NULL DEFAULT '',
+//	  reason       TEXT NOT NULL DEFAULT '',
+//	  cancelled_at TIMESTAMPTZ NOT NULL DEFAULT now()
+//	)
+type postgresCancelStore struct {
+	db    *sql.DB
+	table string
+}
+
+var sqlIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+func newPostgresCancelStore(dsn, table string) (*postgresCancelStore, error) {
+	if !sqlIdentRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid --cancel-table %q", table)
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "postgres open failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  run_id       TEXT NOT NULL DEFAULT '',
+  commit_sha   TEXT NOT NULL DEFAULT '',
+  reason       TEXT NOT NULL DEFAULT '',
+  cancelled_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`, table))
+
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "postgres create table %v failed", table)
+	}
+
+	return &postgresCancelStore{db: db, table: table}, nil
+}
+
+func (s *postgresCancelStore) Cancelled(ctx context.Context, runID, commitSha string) (bool, error) {
+	q := fmt.Sprintf(`SELECT 1 FROM %s
+WHERE ($1 <> '' AND run_id = $1) OR ($2 <> '' AND commit_sha = $2) LIMIT 1`, s.table)
+
+	var one int
+	err := s.db.QueryRowContext(ctx, q, runID, commitSha).Scan(&one)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+func (s *postgresCancelStore) Cancel(ctx context.Context, runID, commitSha, reason string) error {
+	q := fmt.Sprintf(`INSERT INTO %s (run_id, commit_sha, reason) VALUES ($1, $2, $3)`, s.table)
+	_, err := s.db.ExecContext(ctx, q, runID, commitSha, reason)
+	return err
+}
+
+// How long redisCancelStore keeps cancellations.
+const redisCancelTTL = time.Hour * 24 * 7
+
+// redisCancelStore keeps a key per cancelled run ID and commit SHA, i.e.
+// "oops:cancel:run:<id>" and "oops:cancel:sha:<sha>", expiring after
+// redisCancelTTL.
+type redisCancelStore struct {
+	client *redis.Client
+}
+
+// redisCancelKeys returns the keys of runID and commitSha, if not empty.
+func redisCancelKeys(runID, commitSha string) []string {
+	var keys []string
+	if runID != "" {
+		keys = append(keys, "oops:cancel:run:"+runID)
+	}
+
+	if commitSha != "" {
+		keys = append(keys, "oops:cancel:sha:"+commitSha)
+	}
+
+	return keys
+}
+
+func (s *redisCancelStore) Cancelled(ctx context.Context, runID, commitSha string) (bool, error) {
+	keys := redisCancelKeys(runID, commitSha)
+	if len(keys) == 0 {
+		return false, nil
+	}
+
+	n, err := s.client.Exists(ctx, keys...).Result()
+	return n > 0, err
+}
+
+func (s *redisCancelStore) Cancel(ctx context.Context, runID, commitSha, reason string) error {
+	pipe := s.client.TxPipeline()
+	for _, k := range redisCancelKeys(runID, commitSha) {
+		pipe.Set(ctx, k, reason, redisCancelTTL)
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// httpCancelStore uses an HTTP endpoint (--cancel-url): cancellations are
+// looked up with GET <url>?run_id=...&commit_sha=..., answering
+// {"cancelled":true|false} as cancelEntry.matches does, and recorded with a POST
+// of the cancelEntry JSON.
+type httpCancelStore struct {
+	url    string
+	client *http.Client
+}
+
+// cancelEntry is a recorded cancellation, for the HTTP and file stores.
+type cancelEntry struct {
+	RunID       string    `json:"run_id,omitempty"`
+	CommitSha   string    `json:"commit_sha,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	CancelledAt time.Time `json:"cancelled_at"`
+}
+
+// matches returns true if e cancels runID or commitSha.
+func (e cancelEntry) matches(runID, commitSha string) bool {
+	return (runID != "" && e.RunID == runID) || (commitSha != "" && e.CommitSha == commitSha)
+}
+
+func (s *httpCancelStore) Cancelled(ctx context.Context, runID, commitSha string) (bool, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return false, err
+	}
+
+	q := u.Query()
+	q.Set("run_id", runID)
+	q.Set("commit_sha", commitSha)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("GET %v: %v", s.url, resp.Status)
+	}
+
+	var v struct {
+		Cancelled bool `json:"cancelled"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return false, errors.Wrapf(err, "GET %v", s.url)
+	}
+
+	return v.Cancelled, nil
+}
+
+func (s *httpCancelStore) Cancel(ctx context.Context, runID, commitSha, reason string) error {
+	b, _ := json.Marshal(cancelEntry{RunID: runID, CommitSha: commitSha, Reason: reason, CancelledAt: time.Now().UTC()})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %v: %v", s.url, resp.Status)
+	}
+
+	return nil
+}
+
+// fileCancelStore appends cancellations to a local file (--cancel-url), one
+// cancelEntry JSON per line. For a single pod, or a volume shared by all pods.
+type fileCancelStore struct {
+	mtx  sync.Mutex
+	path string
+}
+
+func (s *fileCancelStore) Cancelled(ctx context.Context, runID, commitSha string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e cancelEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.matches(runID, commitSha) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func (s *fileCancelStore) Cancel(ctx context.Context, runID, commitSha, reason string) error {
+	b, _ := json.Marshal(cancelEntry{RunID: runID, CommitSha: commitSha, Reason: reason, CancelledAt: time.Now().UTC()})
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
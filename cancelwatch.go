@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	cancelSeenTTL  = time.Minute * 10 // runs not looked up since are no longer refreshed
+	cancelCacheTTL = time.Hour * 24   // how long a cancellation is remembered
+)
+
+// cancelWatcher keeps the cancelled runs in memory, and cancels the context of
+// the scenarios of a run as soon as it's cancelled. Cancellations come from the
+// 'cancel' broadcast on --cancel-pubsub, seen by all pods, and from the cancel
+// store: a run is looked up once, the first time it's seen, then refreshed every
+// --cancel-refresh while it's running, in case a broadcast is missed.
+type cancelWatcher struct {
+	store     CancelStore // nil if none
+	mtx       sync.Mutex
+	cancelled map[string]time.Time     // cancelWatchKeys -> when cancelled
+	seen      map[[2]string]time.Time  // {run ID, commit SHA} -> last lookup
+	watches   map[*watchedRun]struct{} // running scenarios, see watch
+}
+
+// watchedRun is the context of a running scenario, see watch.
+type watchedRun struct {
+	runID     string
+	commitSha string
+	cancel    context.CancelFunc
+}
+
+func newCancelWatcher(store CancelStore) *cancelWatcher {
+	return &cancelWatcher{
+		store:     store,
+		cancelled: make(map[string]time.Time),
+		seen:      make(map[[2]string]time.Time),
+		watches:   make(map[*watchedRun]struct{}),
+	}
+}
+
+// cancelWatchKeys returns the cache keys of runID and commitSha, if not empty.
+func cancelWatchKeys(runID, commitSha string) []string {
+	var keys []string
+	if runID != "" {
+		keys = append(keys, "run:"+runID)
+	}
+
+	if commitSha != "" {
+		keys = append(keys, "sha:"+commitSha)
+	}
+
+	return keys
+}
+
+func (w *cancelWatcher) isCancelledLocked(runID, commitSha string) bool {
+	for _, k := range cancelWatchKeys(runID, commitSha) {
+		if _, ok := w.cancelled[k]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cancelled returns true if runID or commitSha is cancelled. Only the first
+// call for a run looks up the store; after that, refresh keeps the cache
+// current. Lookup errors are logged, and not treated as cancelled.
+func (w *cancelWatcher) Cancelled(runID, commitSha string) bool {
+	if runID == "" && commitSha == "" {
+		return false
+	}
+
+	k := [2]string{runID, commitSha}
+	w.mtx.Lock()
+	cancelled := w.isCancelledLocked(runID, commitSha)
+	_, seen := w.seen[k]
+	if seen {
+		w.seen[k] = time.Now()
+	}
+
+	w.mtx.Unlock()
+	if cancelled || seen || w.store == nil {
+		return cancelled
+	}
+
+	cancelled, err := w.lookup(runID, commitSha)
+	if err != nil {
+		log.Printf("isRunCancelled: run_id=%s commit_sha=%s: %v", runID, commitSha, err)
+		return false
+	}
+
+	w.mtx.Lock()
+	w.seen[k] = time.Now()
+	w.mtx.Unlock()
+	if cancelled {
+		w.markCancelled(runID, commitSha)
+	}
+
+	return cancelled
+}
+
+func (w *cancelWatcher) lookup(runID, commitSha string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return w.store.Cancelled(ctx, runID, commitSha)
+}
+
+// markCancelled records the cancellation of runID and/or commitSha, and cancels
+// the contexts of their running scenarios.
+func (w *cancelWatcher) markCancelled(runID, commitSha string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, k := range cancelWatchKeys(runID, commitSha) {
+		if _, ok := w.cancelled[k]; !ok {
+			w.cancelled[k] = time.Now()
+		}
+	}
+
+	for rw := range w.watches {
+		if w.isCancelledLocked(rw.runID, rw.commitSha) {
+			log.Printf("cancel: interrupting run_id=%s commit_sha=%s", rw.runID, rw.commitSha)
+			rw.cancel()
+		}
+	}
+}
+
+// watch returns a context derived from parent that is cancelled when runID or
+// commitSha is, and a function to call when done with it.
+func (w *cancelWatcher) watch(parent context.Context, runID, commitSha string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	if runID == "" && commitSha == "" {
+		return ctx, cancel
+	}
+
+	rw := &watchedRun{runID: runID, commitSha: commitSha, cancel: cancel}
+	w.mtx.Lock()
+	w.watches[rw] = struct{}{}
+	w.mtx.Unlock()
+	if w.Cancelled(runID, commitSha) {
+		cancel()
+	}
+
+	return ctx, func() {
+		w.mtx.Lock()
+		delete(w.watches, rw)
+		w.mtx.Unlock()
+		cancel()
+	}
+}
+
+// refresh looks up the store again for the runs seen recently and not yet
+// cancelled, and forgets old entries.
+func (w *cancelWatcher) refresh() {
+	now := time.Now()
+	var runs [][2]string
+	w.mtx.Lock()
+	for rw := range w.watches {
+		w.seen[[2]string{rw.runID, rw.commitSha}] = now // still running
+	}
+
+	for k, t := range w.seen {
+		switch {
+		case now.Sub(t) > cancelSeenTTL:
+			delete(w.seen, k)
+		case !w.isCancelledLocked(k[0], k[1]):
+			runs = append(runs, k)
+		}
+	}
+
+	for k, t := range w.cancelled {
+		if now.Sub(t) > cancelCacheTTL {
+			delete(w.cancelled, k)
+		}
+	}
+
+	w.mtx.Unlock()
+	if w.store == nil {
+		return
+	}
+
+	for _, k := range runs {
+		cancelled, err := w.lookup(k[0], k[1])
+		if err != nil {
+			log.Printf("cancel refresh: run_id=%s commit_sha=%s: %v", k[0], k[1], err)
+			continue
+		}
+
+		if cancelled {
+			w.markCancelled(k[0], k[1])
+		}
+	}
+}
+
+// run refreshes the cache every interval until ctx is done.
+func (w *cancelWatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.refresh()
+		}
+	}
+}
+
+// handleBroadcast handles a 'cancel' command received on --cancel-pubsub.
+func (w *cancelWatcher) handleBroadcast(data []byte) error {
+	var c cmd
+	if err := json.Unmarshal(data, &c); err != nil {
+		log.Printf("cancel broadcast: unmarshal failed: %v", err)
+		return nil // not retried
+	}
+
+	if c.Code != "cancel" {
+		return nil
+	}
+
+	commitSha, _ := c.Metadata["commit_sha"].(string)
+	log.Printf("cancel broadcast: run_id=%s commit_sha=%s", c.ID, commitSha)
+	w.markCancelled(c.ID, commitSha)
+	return nil
+}
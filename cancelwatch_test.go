@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCancelStore counts the lookups of a CancelStore.
+type countingCancelStore struct {
+	CancelStore
+	lookups atomic.Int32
+}
+
+func (s *countingCancelStore) Cancelled(ctx context.Context, runID, commitSha string) (bool, error) {
+	s.lookups.Add(1)
+	return s.CancelStore.Cancelled(ctx, runID, commitSha)
+}
+
+func Test__cancelWatcher(t *testing.T) {
+	store := &countingCancelStore{CancelStore: &fileCancelStore{path: filepath.Join(t.TempDir(), "cancels.jsonl")}}
+	w := newCancelWatcher(store)
+	for i := 0; i < 5; i++ {
+		if w.Cancelled("run1", "abc") {
+			t.Fatal("run1 cancelled")
+		}
+	}
+
+	if n := store.lookups.Load(); n != 1 {
+		t.Fatalf("expected 1 lookup, got %v", n)
+	}
+
+	ctx, stop := w.watch(context.Background(), "run1", "abc")
+	defer stop()
+
+	// Cancelled by another pod, seen on refresh.
+	store.Cancel(context.Background(), "", "abc", "pr closed")
+	if w.Cancelled("run1", "abc") || ctx.Err() != nil {
+		t.Fatal("cancelled before refresh")
+	}
+
+	w.refresh()
+	if !w.Cancelled("run1", "abc") || ctx.Err() == nil {
+		t.Fatal("not cancelled after refresh")
+	}
+
+	// Already cancelled: the context of a new scenario is done right away.
+	ctx2, stop2 := w.watch(context.Background(), "run2", "abc")
+	defer stop2()
+	if ctx2.Err() == nil {
+		t.Fatal("run2 not cancelled")
+	}
+}
+
+func Test__cancelWatcherBroadcast(t *testing.T) {
+	w := newCancelWatcher(nil)
+	ctx1, stop1 := w.watch(context.Background(), "run1", "abc")
+	defer stop1()
+	ctx2, stop2 := w.watch(context.Background(), "run2", "def")
+	defer stop2()
+	ctx3, stop3 := w.watch(context.Background(), "", "abc") // no run ID
+	defer stop3()
+
+	// A commit-only cancel interrupts all the running scenarios of the commit,
+	// with a run ID or not.
+	b, _ := json.Marshal(cmd{Code: "cancel", Metadata: map[string]interface{}{"commit_sha": "abc"}})
+	w.handleBroadcast(b)
+	if ctx1.Err() == nil || !w.Cancelled("run1", "abc") {
+		t.Fatal("run1 not cancelled")
+	}
+
+	if ctx3.Err() == nil {
+		t.Fatal("commit abc not cancelled")
+	}
+
+	if ctx2.Err() != nil || w.Cancelled("run2", "def") {
+		t.Fatal("run2 cancelled")
+	}
+
+	// Other commands are ignored.
+	b, _ = json.Marshal(cmd{Code: "process", ID: "run2"})
+	w.handleBroadcast(b)
+	if ctx2.Err() != nil {
+		t.Fatal("run2 cancelled by a process command")
+	}
+
+	b, _ = json.Marshal(cmd{Code: "cancel", ID: "run2"})
+	w.handleBroadcast(b)
+	if ctx2.Err() == nil {
+		t.Fatal("run2 not cancelled")
+	}
+
+	stop1()
+	stop2()
+	stop3()
+	if len(w.watches) != 0 {
+		t.Fatalf("expected no watches, got %v", len(w.watches))
+	}
+}
+
+// Test__cancelInterruptsScenario checks that a 'cancel' command interrupts the
+// in-flight request of a running scenario, through the broadcast.
+func Test__cancelInterruptsScenario(t *testing.T) {
+	defer func(p string) { cancelpubsub = p }(cancelpubsub)
+	cancelpubsub = "cancels"
+	started := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second * 30):
+		}
+	}))
+
+	defer ts.Close()
+	dir := t.TempDir()
+	f := filepath.Join(dir, "slow.yaml")
+	os.WriteFile(f, []byte(`
+run:
+- http: {method: GET, url: `+ts.URL+`, asserts: {status_code: 200}}
+- http: {method: GET, url: `+ts.URL+`/never, asserts: {status_code: 200}}
+`), 0644)
+
+	tr := newMemTransport()
+	pub, _ := tr.Publisher(cancelpubsub)
+	app := &appctx{
+		ctx:         context.Background(),
+		mtx:         &sync.Mutex{},
+		transport:   tr,
+		cancelWatch: newCancelWatcher(nil),
+		cancelPub:   pub,
+		suites:      newSuiteCache(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tr.SubscribeTopic(ctx, cancelpubsub, "", nil, app.cancelWatch.handleBroadcast)
+
+	go func() {
+		<-started
+		b, _ := json.Marshal(cmd{Code: "cancel", ID: "run1"})
+		process(&appctx{mtx: &sync.Mutex{}, cancelPub: pub}, b) // i.e. another pod
+	}()
+
+	start := time.Now()
+	doScenario(context.Background(), &doScenarioInput{
+		app:           app,
+		ScenarioFiles: []string{f},
+		ReportPubsub:  "reports",
+		RunID:         "run1",
+	})
+
+	if d := time.Since(start); d > time.Second*10 {
+		t.Fatalf("not interrupted, took %v", d)
+	}
+
+	reports := tr.Reports()
+	if len(reports) != 1 || reports[0].Status != "cancelled" {
+		t.Fatalf("expected a cancelled report, got %+v", reports)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Cleanup represents the 'cleanup' section of a scenario: 'run' entries and/or
+// a script that always run last, after failures, cancellation, and shutdown.
+// It can also be written as a plain script string.
+type Cleanup struct {
+	Run    []Run  `yaml:"run"`
+	Script string `yaml:"script"`
+
+	name string // i.e. cleanup, cleanup.login.yaml
+}
+
+// UnmarshalYAML accepts either a script string or a {run, script} mapping.
+func (c *Cleanup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var script string
+	if err := unmarshal(&script); err == nil {
+		c.Script = script
+		return nil
+	}
+
+	type plain Cleanup
+	return unmarshal((*plain)(c))
+}
+
+func (c *Cleanup) empty() bool { return len(c.Run) == 0 && c.Script == "" }
+
+// runCleanup runs all the cleanup sections of scenario file f (its own first,
+// then the ones from included fragments) and returns their errors. These are
+// not added to s.errs so cleanup failures don't mask the scenario's result.
+func (s *Scenario) runCleanup(f string) []error {
+	// Not interrupted by the run's cancellation.
+	ctx := s.ctx
+	s.ctx = context.WithoutCancel(s.runCtx())
+	defer func() { s.ctx = ctx }()
+	n := len(s.errs)
+	basef := filepath.Base(f)
+	for _, c := range s.cleanups {
+		for i := range c.Run {
+			prefix := filepath.Join(os.TempDir(), fmt.Sprintf("%v_%v%d", basef, c.name, i))
+			s.runStep(i, prefix, &c.Run[i])
+		}
+
+		if c.Script != "" {
+			s.runBlock(basef, namedScript{c.name, c.Script})
+		}
+	}
+
+	errs := append([]error{}, s.errs[n:]...)
+	s.errs = s.errs[:n]
+	return errs
+}
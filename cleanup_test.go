@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+func Test__runCleanup(t *testing.T) {
+	var deleted bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			deleted = true
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer ts.Close()
+	var s Scenario
+	err := yaml.Unmarshal([]byte(`
+run:
+- http: {method: POST, url: `+ts.URL+`, asserts: {status_code: 201}}
+- http: {method: GET, url: `+ts.URL+`, asserts: {status_code: 200}}
+- http: {method: GET, url: `+ts.URL+`, asserts: {status_code: 200}}
+cleanup:
+  run:
+  - when: steps.0.status == 'success'
+    http: {method: DELETE, url: `+ts.URL+`, asserts: {status_code: 200}}
+  - when: steps.1.status == 'success'
+    http: {method: DELETE, url: `+ts.URL+`/never, asserts: {status_code: 200}}
+  - http: {method: PUT, url: `+ts.URL+`, asserts: {status_code: 200}}
+`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.me = &s
+	s.input = &doScenarioInput{}
+	if err := s.resolveIncludes(t.TempDir()+"/s.yaml", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s.runSteps(t.TempDir() + "/s.yaml")
+
+	// Steps are interrupted on shutdown, but cleanup still runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.input.app = &appctx{ctx: ctx, mtx: &sync.Mutex{}}
+	if !s.interrupted(0, "s.yaml") {
+		t.Fatal("expected interrupted on shutdown")
+	}
+
+	errs := s.runCleanup(t.TempDir() + "/s.yaml")
+	if !deleted {
+		t.Fatal("expected cleanup DELETE")
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 cleanup error, got %v", errs)
+	}
+
+	if len(s.errs) != 2 {
+		t.Fatalf("expected 2 scenario errors, got %v", s.errs)
+	}
+}
+
+// Test__shutdownInterruptsScenario checks that a scenario stopped by a shutdown
+// is reported as interrupted, not cancelled.
+func Test__shutdownInterruptsScenario(t *testing.T) {
+	appCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shutdown() // i.e. SIGTERM while the first step runs
+	}))
+
+	defer ts.Close()
+	f := filepath.Join(t.TempDir(), "s.yaml")
+	os.WriteFile(f, []byte(`
+run:
+- http: {method: GET, url: `+ts.URL+`, asserts: {status_code: 200}}
+- http: {method: GET, url: `+ts.URL+`/never, asserts: {status_code: 200}}
+`), 0644)
+
+	tr := newMemTransport()
+	app := &appctx{
+		ctx:         appCtx,
+		mtx:         &sync.Mutex{},
+		transport:   tr,
+		cancelWatch: newCancelWatcher(nil),
+		suites:      newSuiteCache(),
+	}
+
+	doScenario(context.Background(), &doScenarioInput{
+		app:           app,
+		ScenarioFiles: []string{f},
+		ReportPubsub:  "reports",
+		RunID:         "run1",
+	})
+
+	reports := tr.Reports()
+	if len(reports) != 1 || reports[0].Status != "interrupted" {
+		t.Fatalf("expected an interrupted report, got %+v", reports)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Possible values for stepResult.Status.
+const (
+	stepSuccess = "success"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+// stepResult is the outcome of a single 'run' entry.
+type stepResult struct {
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code,omitempty"`
+}
+
+// condLexer lexes 'when' expressions.
+var condLexer = exprLexer{
+	ops: []string{"(", ")", "!", "==", "!=", "&&", "||"},
+	word: func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_.-", c)
+	},
+}
+
+// lexCondition returns the tokens of expr, numbers and booleans being literals,
+// not variables.
+func lexCondition(expr string) ([]exprToken, error) {
+	toks, err := condLexer.lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, t := range toks {
+		if t.op == "" && !t.lit {
+			_, err := strconv.ParseFloat(t.val, 64)
+			toks[i].lit = err == nil || t.val == "true" || t.val == "false"
+		}
+	}
+
+	return toks, nil
+}
+
+// condParser is a recursive descent evaluator for 'when' expressions:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = operand [ ( "==" | "!=" ) operand ]
+//	operand = "(" expr ")" | variable | literal
+type condParser struct {
+	toks   []exprToken
+	pos    int
+	lookup func(string) string
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos].op
+	}
+
+	return ""
+}
+
+func (p *condParser) expr() (string, error) {
+	l, err := p.and()
+	if err != nil {
+		return "", err
+	}
+
+	for p.peek() == "||" {
+		p.pos++
+		r, err := p.and()
+		if err != nil {
+			return "", err
+		}
+
+		l = strconv.FormatBool(truthy(l) || truthy(r))
+	}
+
+	return l, nil
+}
+
+func (p *condParser) and() (string, error) {
+	l, err := p.unary()
+	if err != nil {
+		return "", err
+	}
+
+	for p.peek() == "&&" {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return "", err
+		}
+
+		l = strconv.FormatBool(truthy(l) && truthy(r))
+	}
+
+	return l, nil
+}
+
+func (p *condParser) unary() (string, error) {
+	if p.peek() == "!" {
+		p.pos++
+		v, err := p.unary()
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatBool(!truthy(v)), nil
+	}
+
+	return p.compare()
+}
+
+func (p *condParser) compare() (string, error) {
+	l, err := p.operand()
+	if err != nil {
+		return "", err
+	}
+
+	switch op := p.peek(); op {
+	case "==", "!=":
+		p.pos++
+		r, err := p.operand()
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatBool((l == r) == (op == "==")), nil
+	}
+
+	return l, nil
+}
+
+func (p *condParser) operand() (string, error) {
+	if p.pos >= len(p.toks) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+
+	t := p.toks[p.pos]
+	p.pos++
+	switch {
+	case t.op == "(":
+		v, err := p.expr()
+		if err != nil {
+			return "", err
+		}
+
+		if p.peek() != ")" {
+			return "", fmt.Errorf("missing ')'")
+		}
+
+		p.pos++
+		return v, nil
+	case t.op != "":
+		return "", fmt.Errorf("unexpected %q", t.op)
+	case t.lit:
+		return t.val, nil
+	default:
+		return p.lookup(t.val), nil
+	}
+}
+
+// truthy returns false for empty, "false" and "0" values.
+func truthy(v string) bool {
+	return v != "" && v != "false" && v != "0"
+}
+
+// evalCondition evaluates a 'when' expression. Variables are resolved through
+// lookup; unknown variables resolve to an empty string.
+func evalCondition(expr string, lookup func(string) string) (bool, error) {
+	toks, err := lexCondition(expr)
+	if err != nil {
+		return false, err
+	}
+
+	p := &condParser{toks: toks, lookup: lookup}
+	v, err := p.expr()
+	if err != nil {
+		return false, err
+	}
+
+	if p.pos < len(toks) {
+		return false, fmt.Errorf("unexpected token at %d", p.pos)
+	}
+
+	return truthy(v), nil
+}
+
+// lookupVar resolves the variables available to 'when' expressions:
+//
+//	env.<NAME>                 scenario env, then the process environment
+//	metadata.<key>             string values from the run metadata
+//	steps.<index>.status       success|failed|skipped
+//	steps.<index>.status_code  http status code, if any
+//	previous.status            same as above, for the previous step
+//	previous.status_code
+//	failed                     true if the scenario has failed so far
+func (s *Scenario) lookupVar(results []stepResult) func(string) string {
+	step := func(r stepResult, field string) string {
+		switch field {
+		case "status":
+			return r.Status
+		case "status_code":
+			return strconv.Itoa(r.StatusCode)
+		}
+
+		return ""
+	}
+
+	return func(name string) string {
+		parts := strings.SplitN(name, ".", 3)
+		switch {
+		case name == "failed":
+			return strconv.FormatBool(len(s.errs) > 0)
+		case parts[0] == "env" && len(parts) > 1:
+			k := strings.TrimPrefix(name, "env.")
+			if v, ok := s.Env[k]; ok {
+				return v
+			}
+
+			return os.Getenv(k)
+		case parts[0] == "metadata" && len(parts) > 1 && s.input != nil:
+			v, _ := s.input.Metadata[strings.TrimPrefix(name, "metadata.")].(string)
+			return v
+		case parts[0] == "previous" && len(parts) == 2 && len(results) > 0:
+			return step(results[len(results)-1], parts[1])
+		case parts[0] == "steps" && len(parts) == 3:
+			i, err := strconv.Atoi(parts[1])
+			if err != nil || i < 0 || i >= len(results) {
+				return ""
+			}
+
+			return step(results[i], parts[2])
+		}
+
+		return ""
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test__evalCondition(t *testing.T) {
+	s := &Scenario{
+		Env:   map[string]string{"STAGE": "dev"},
+		input: &doScenarioInput{Metadata: map[string]interface{}{"branch": "main"}},
+	}
+
+	results := []stepResult{
+		{Status: stepSuccess, StatusCode: 201},
+		{Status: stepFailed, StatusCode: 500},
+	}
+
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{"steps.0.status == 'success'", true},
+		{"steps.0.status_code == 201 && previous.status == failed", false},
+		{`previous.status == "failed"`, true},
+		{"env.STAGE == 'dev' && metadata.branch != 'prod'", true},
+		{"!(env.STAGE == 'dev') || steps.1.status_code == 500", true},
+		{"env.NOT_SET", false},
+		{"!env.NOT_SET", true},
+		{"failed", false},
+		{"steps.5.status == 'success'", false},
+	} {
+		got, err := evalCondition(tc.expr, s.lookupVar(results))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.expr, err)
+		}
+
+		if got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+
+	for _, expr := range []string{"(a == b", "a = b", "a ==", "'open", "a b"} {
+		if _, err := evalCondition(expr, s.lookupVar(nil)); err == nil {
+			t.Errorf("%v: expected error", expr)
+		}
+	}
+}
+
+func Test__runStepsFailFast(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer ts.Close()
+	step := func(path string) Run {
+		return Run{HTTP: RunHTTP{Method: "GET", URL: ts.URL + path, Asserts: &Asserts{Code: 200}}}
+	}
+
+	s := Scenario{FailFast: true, input: &doScenarioInput{}}
+	s.me = &s
+	s.Run = []Run{step("/ok"), step("/fail"), step("/ok")}
+	s.Run[1].ContinueOnError = true
+	s.Run = append(s.Run, Run{When: "previous.status == 'failed'", HTTP: step("/ok").HTTP})
+	s.Run = append(s.Run, step("/fail"), step("/ok"))
+	s.runSteps(t.TempDir() + "/scenario.yaml")
+
+	want := []string{stepSuccess, stepFailed, stepSuccess, stepSkipped, stepFailed, stepSkipped}
+	if len(s.steps) != len(want) {
+		t.Fatalf("got %v, want %v", s.steps, want)
+	}
+
+	for i, r := range s.steps {
+		if r.Status != want[i] {
+			t.Errorf("step %d: got %v, want %v", i, r.Status, want[i])
+		}
+	}
+
+	if len(s.errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", s.errs)
+	}
+}
+
+func Test__runStepWhenError(t *testing.T) {
+	s := Scenario{input: &doScenarioInput{}}
+	s.me = &s
+	bad := Run{When: "steps.0.status ==", HTTP: RunHTTP{Method: "GET", URL: "http://localhost:1"}}
+	s.Run = []Run{bad, bad}
+	s.Run[0].ContinueOnError = true
+	s.runSteps(t.TempDir() + "/scenario.yaml")
+
+	// The broken condition is ignored with continue_on_error, and the step not run.
+	if s.steps[0].Status != stepSkipped || s.steps[1].Status != stepFailed {
+		t.Fatalf("unexpected steps %v", s.steps)
+	}
+
+	if len(s.errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", s.errs)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Name of the ignore file at the root of --dir (or the overlay dir). One glob
+// per line, same syntax as --exclude; '#' starts a comment.
+const ignoreFile = ".oopsignore"
+
+// discoveryLayouts are the named presets for --discovery-layout: the include
+// globs used when --include is not set.
+var discoveryLayouts = map[string][]string{
+	// Our services/*/scenarios, cronjobs/*/scenarios, etc. convention.
+	"scenarios": {"**/scenarios/**/*.yaml", "**/scenarios/**/*.yml"},
+	// Every yaml file under --dir, i.e. --dir ./examples/.
+	"flat": {"**/*.yaml", "**/*.yml"},
+}
+
+// discovery holds the rules for finding scenario files under a root dir.
+type discovery struct {
+	include []string
+	exclude []string
+	follow  bool
+}
+
+// newDiscovery returns the discovery rules from the --discovery-layout,
+// --include, --exclude and --follow-symlinks flags.
+func newDiscovery() (*discovery, error) {
+	d := &discovery{include: discoveryinclude, exclude: discoveryexclude, follow: followsymlinks}
+	if len(d.include) == 0 {
+		globs, ok := discoveryLayouts[discoverylayout]
+		if !ok {
+			return nil, fmt.Errorf("unknown --discovery-layout %q", discoverylayout)
+		}
+
+		d.include = globs
+	}
+
+	for _, g := range append(append([]string{}, d.include...), d.exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(g, "**", "*"), ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid glob %q", g)
+		}
+	}
+
+	return d, nil
+}
+
+// matchGlob matches slash-separated name against pattern, where a '**' segment
+// matches zero or more path segments. Patterns without '/' match the base name
+// at any depth, like .gitignore.
+func matchGlob(pattern, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(strings.TrimPrefix(name, "/"), "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// matchAny returns true if any of globs matches file, either relative to the
+// root dir or as an absolute path (so 'scenarios' also matches --dir itself).
+func matchAny(globs []string, rel, abs string) bool {
+	for _, g := range globs {
+		if matchGlob(g, rel) || matchGlob(g, filepath.ToSlash(abs)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readIgnore returns the globs from the .oopsignore file in root, if any.
+func readIgnore(root string) []string {
+	f, err := os.Open(filepath.Join(root, ignoreFile))
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
+	}
+
+	return out
+}
+
+// find returns the absolute paths of the scenario files under root, sorted.
+// Shared fragments and suite files are skipped.
+func (d *discovery) find(root string) []string {
+	if root == "" {
+		return nil
+	}
+
+	absRoot, _ := filepath.Abs(root)
+	exclude := append(append([]string{}, d.exclude...), readIgnore(absRoot)...)
+	visited := make(map[string]bool) // real dir paths, to catch symlink cycles
+	var out []string
+	var walk func(dir, rel string)
+	walk = func(dir, rel string) {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			if visited[real] {
+				return
+			}
+
+			visited[real] = true
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("discovery: %v", err)
+			return
+		}
+
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			r := path.Join(rel, e.Name())
+			isDir := e.IsDir()
+			if e.Type()&os.ModeSymlink != 0 {
+				fi, err := os.Stat(p)
+				if err != nil {
+					log.Printf("discovery: broken symlink %v", p)
+					continue
+				}
+
+				isDir = fi.IsDir()
+				if isDir && !d.follow {
+					continue
+				}
+			}
+
+			if matchAny(exclude, r, p) {
+				continue
+			}
+
+			if isDir {
+				walk(p, r)
+				continue
+			}
+
+			if !matchAny(d.include, r, p) {
+				continue
+			}
+
+			if isFragment(p) {
+				continue // shared fragment, only used through include/uses
+			}
+
+			if filepath.Base(p) == suiteFile {
+				continue // suite setup/teardown, not a scenario
+			}
+
+			out = append(out, p)
+		}
+	}
+
+	walk(absRoot, "")
+	sort.Strings(out)
+	return out
+}
+
+// findScenarioFiles returns the scenario files under root, as per the discovery
+// flags. Invalid flags are fatal.
+func findScenarioFiles(root string) []string {
+	d, err := newDiscovery()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := d.find(root)
+	for _, f := range out {
+		log.Printf("input: %v", f)
+	}
+
+	return out
+}
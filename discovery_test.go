@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test__discoveryFind(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "services/b/scenarios/02.yaml", "run: []")
+	writeTestFile(t, root, "services/b/scenarios/01.yml", "run: []")
+	writeTestFile(t, root, "services/b/scenarios/login.yaml", "fragment: true")
+	writeTestFile(t, root, "services/b/suite.yaml", "setup: ''")
+	writeTestFile(t, root, "services/b/scenarios/suite.yaml", "setup: ''")
+	writeTestFile(t, root, "services/a/scenarios/wip/x.yaml", "run: []")
+	writeTestFile(t, root, "services/a/scenarios/01.yaml", "run: []")
+	writeTestFile(t, root, "services/a/config.yaml", "x: 1")
+	writeTestFile(t, root, "shared/scenarios/01.yaml", "run: []")
+	writeTestFile(t, root, ".oopsignore", "# wip stuff\nwip/\n")
+	os.Symlink(filepath.Join(root, "shared"), filepath.Join(root, "services", "c"))
+	os.Symlink(root, filepath.Join(root, "services", "loop"))
+
+	rel := func(files []string) []string {
+		var out []string
+		for _, f := range files {
+			r, _ := filepath.Rel(root, f)
+			out = append(out, filepath.ToSlash(r))
+		}
+
+		return out
+	}
+
+	d := &discovery{include: discoveryLayouts["scenarios"]}
+	want := []string{
+		"services/a/scenarios/01.yaml",
+		"services/b/scenarios/01.yml",
+		"services/b/scenarios/02.yaml",
+		"shared/scenarios/01.yaml",
+	}
+
+	if got := rel(d.find(root)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	d = &discovery{include: discoveryLayouts["flat"], exclude: []string{"shared", "services/b/**"}, follow: true}
+	want = []string{
+		"services/a/config.yaml",
+		"services/a/scenarios/01.yaml",
+		"services/c/scenarios/01.yaml",
+	}
+
+	if got := rel(d.find(root)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// The scenarios layout also applies when --dir is a scenarios dir itself.
+	d = &discovery{include: discoveryLayouts["scenarios"]}
+	if got := d.find(filepath.Join(root, "services", "a", "scenarios")); len(got) != 2 {
+		t.Fatalf("expected 2 files, got %v", got)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/pkg/errors"
+)
+
+// Maximum nesting of includes/uses, mostly to catch include cycles.
+const maxIncludeDepth = 8
+
+// Fragment files are marked with a top-level 'fragment: true' so they are not
+// discovered (and distributed) as scenarios themselves.
+var fragmentRe = regexp.MustCompile(`(?m)^fragment:\s*true\s*$`)
+
+// Include represents a shared fragment to pull into a scenario. It can also be
+// written as a plain path string.
+type Include struct {
+	Path string            `yaml:"path"`
+	With map[string]string `yaml:"with"`
+}
+
+// UnmarshalYAML accepts either a path string or a {path, with} mapping.
+func (inc *Include) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		inc.Path = path
+		return nil
+	}
+
+	type plain Include
+	return unmarshal((*plain)(inc))
+}
+
+// namedScript is a prepare/check script, named after where it came from.
+type namedScript struct {
+	Name   string // i.e. prepare, prepare.login.yaml
+	Script string
+}
+
+// isFragment returns true if file is a shared fragment, not a scenario.
+func isFragment(file string) bool {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	return fragmentRe.Match(b)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// resolveInclude finds the fragment at path, relative to the including file,
+// then relative to --dir. If overlayDir is set, an overlay copy of the fragment
+// (same path relative to --dir) takes precedence over the baked-in one.
+func resolveInclude(path, from, overlayDir string) (string, error) {
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Join(filepath.Dir(from), path)}
+		if overlayDir != "" && dir != "" {
+			// The including file may be an overlay copy; also try relative to
+			// its baked-in location.
+			if within(overlayDir, from) {
+				rel, _ := filepath.Rel(overlayDir, from)
+				candidates = append(candidates, filepath.Join(dir, filepath.Dir(rel), path))
+			}
+		}
+
+		if dir != "" {
+			candidates = append(candidates, filepath.Join(dir, path))
+		}
+	}
+
+	absDir, _ := filepath.Abs(dir)
+	for _, c := range candidates {
+		c, _ = filepath.Abs(c)
+		if overlayDir != "" && dir != "" && within(absDir, c) {
+			rel, _ := filepath.Rel(absDir, c)
+			if o := filepath.Join(overlayDir, rel); fileExists(o) {
+				return o, nil
+			}
+		}
+
+		if fileExists(c) {
+			return c, nil
+		}
+	}
+
+	return "", fmt.Errorf("%v not found (from %v)", path, from)
+}
+
+// fragmentParamRe matches a {{ .NAME }} placeholder in a fragment.
+var fragmentParamRe = regexp.MustCompile(`\{\{\s*\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// renderFragment replaces the {{ .NAME }} placeholders of b that are in params.
+// Anything else, i.e. a literal '{{' in a script or JSON payload, is left as is.
+func renderFragment(b []byte, params map[string]string) []byte {
+	return fragmentParamRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		name := string(fragmentParamRe.FindSubmatch(m)[1])
+		if v, ok := params[name]; ok {
+			return []byte(v)
+		}
+
+		return m
+	})
+}
+
+// loadFragment reads the fragment at path, replaces its params placeholders
+// (i.e. {{ .TENANT }}), then resolves its own includes.
+func loadFragment(path, from, overlayDir string, params map[string]string, depth int) (*Scenario, error) {
+	file, err := resolveInclude(path, from, overlayDir)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var frag Scenario
+	if err := yaml.Unmarshal(renderFragment(b, params), &frag); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	if err := frag.resolveIncludes(file, overlayDir, depth+1); err != nil {
+		return nil, err
+	}
+
+	return &frag, nil
+}
+
+// mergeEnv adds env to s, without overriding existing keys.
+func (s *Scenario) mergeEnv(env map[string]string) {
+	if len(env) == 0 {
+		return
+	}
+
+	if s.Env == nil {
+		s.Env = make(map[string]string)
+	}
+
+	for k, v := range env {
+		if _, ok := s.Env[k]; !ok {
+			s.Env[k] = v
+		}
+	}
+}
+
+// resolveIncludes expands the 'include' entries and 'uses' steps of scenario
+// file, and builds the final list of prepare, check and cleanup sections.
+// Included prepare scripts run before the scenario's own; included check and
+// cleanup sections run after the scenario's own. Included 'run' entries come
+// before the scenario's.
+func (s *Scenario) resolveIncludes(file, overlayDir string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%v: too many nested includes, cycle?", file)
+	}
+
+	var runs []Run
+	var checks []namedScript
+	var cleanups []Cleanup
+	for _, inc := range s.Include {
+		frag, err := loadFragment(inc.Path, file, overlayDir, inc.With, depth)
+		if err != nil {
+			return err
+		}
+
+		s.mergeEnv(frag.Env)
+		s.prepares = append(s.prepares, frag.prepares...)
+		checks = append(checks, frag.checks...)
+		cleanups = append(cleanups, frag.cleanups...)
+		runs = append(runs, frag.Run...)
+	}
+
+	own, err := s.expandUses(s.Run, file, overlayDir, depth)
+	if err != nil {
+		return err
+	}
+
+	s.Run = append(runs, own...)
+	name := func(kind string) string {
+		if depth == 0 {
+			return kind
+		}
+
+		return fmt.Sprintf("%v.%v", kind, filepath.Base(file))
+	}
+
+	if s.Prepare != "" {
+		s.prepares = append(s.prepares, namedScript{name("prepare"), s.Prepare})
+	}
+
+	if s.Check != "" {
+		s.checks = append(s.checks, namedScript{name("check"), s.Check})
+	}
+
+	s.checks = append(s.checks, checks...)
+	if !s.Cleanup.empty() {
+		c := s.Cleanup
+		c.name = name("cleanup")
+		c.Run, err = s.expandUses(c.Run, file, overlayDir, depth)
+		if err != nil {
+			return err
+		}
+
+		s.cleanups = append(s.cleanups, c)
+	}
+
+	s.cleanups = append(s.cleanups, cleanups...)
+	return nil
+}
+
+// expandUses replaces 'uses' entries in runs with the 'run' entries of their
+// fragments. The entry's 'when' and 'continue_on_error' apply to each of them.
+func (s *Scenario) expandUses(runs []Run, file, overlayDir string, depth int) ([]Run, error) {
+	var out []Run
+	for _, r := range runs {
+		if r.Uses == "" {
+			out = append(out, r)
+			continue
+		}
+
+		frag, err := loadFragment(r.Uses, file, overlayDir, r.With, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		s.mergeEnv(frag.Env)
+		for _, fr := range frag.Run {
+			if fr.When == "" {
+				fr.When = r.When
+			}
+
+			fr.ContinueOnError = fr.ContinueOnError || r.ContinueOnError
+			out = append(out, fr)
+		}
+	}
+
+	return out, nil
+}
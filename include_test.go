@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+func Test__resolveIncludes(t *testing.T) {
+	root := t.TempDir()
+	overlay := t.TempDir()
+	writeTestFile(t, root, "shared/login.yaml", `fragment: true
+env:
+  USER: admin
+  STAGE: shared
+prepare: "#!/bin/bash\necho login"
+check: "#!/bin/bash\necho logout"
+`)
+	writeTestFile(t, root, "shared/tenant.yaml", `fragment: true
+run:
+- http:
+    method: POST
+    url: "https://example.com/tenants/{{ .TENANT }}"
+- http:
+    method: DELETE
+    url: "https://example.com/tenants/{{ .TENANT }}"
+`)
+	writeTestFile(t, overlay, "shared/login.yaml", `fragment: true
+env:
+  USER: overlay
+`)
+	f := writeTestFile(t, root, "svc/scenarios/s.yaml", `include:
+- ../../shared/login.yaml
+env:
+  STAGE: dev
+prepare: "#!/bin/bash\necho own"
+check: "#!/bin/bash\necho own"
+run:
+- uses: shared/tenant.yaml
+  with:
+    TENANT: t1
+  continue_on_error: true
+- http:
+    method: GET
+    url: https://example.com
+`)
+
+	defer func(old string) { dir = old }(dir)
+	dir = root
+	load := func(overlayDir string) *Scenario {
+		b, _ := os.ReadFile(f)
+		var s Scenario
+		if err := yaml.Unmarshal(b, &s); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.resolveIncludes(f, overlayDir, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		return &s
+	}
+
+	s := load("")
+	if s.Env["USER"] != "admin" || s.Env["STAGE"] != "dev" {
+		t.Fatalf("unexpected env: %v", s.Env)
+	}
+
+	if len(s.prepares) != 2 || s.prepares[0].Name != "prepare.login.yaml" || s.prepares[1].Name != "prepare" {
+		t.Fatalf("unexpected prepares: %v", s.prepares)
+	}
+
+	if len(s.checks) != 2 || s.checks[0].Name != "check" || s.checks[1].Name != "check.login.yaml" {
+		t.Fatalf("unexpected checks: %v", s.checks)
+	}
+
+	if len(s.Run) != 3 || s.Run[0].HTTP.URL != "https://example.com/tenants/t1" || !s.Run[1].ContinueOnError {
+		t.Fatalf("unexpected run: %+v", s.Run)
+	}
+
+	if s = load(overlay); s.Env["USER"] != "overlay" {
+		t.Fatalf("expected overlay fragment, got env %v", s.Env)
+	}
+
+	if !isFragment(filepath.Join(root, "shared/login.yaml")) || isFragment(f) {
+		t.Fatal("isFragment mismatch")
+	}
+
+	writeTestFile(t, root, "shared/loop.yaml", "fragment: true\ninclude: [loop.yaml]\n")
+	var loop Scenario
+	loop.Include = []Include{{Path: "shared/loop.yaml"}}
+	if err := loop.resolveIncludes(f, "", 0); err == nil {
+		t.Fatal("expected include cycle error")
+	}
+}
+
+func Test__renderFragment(t *testing.T) {
+	in := `url: "https://example.com/{{ .TENANT }}/{{.PLAN}}"
+script: "#!/bin/bash\necho '{{ not a param }}' | jq '{a: .b}' && echo {{ .OTHER }}"
+`
+	want := `url: "https://example.com/t1/pro"
+script: "#!/bin/bash\necho '{{ not a param }}' | jq '{a: .b}' && echo {{ .OTHER }}"
+`
+	if got := string(renderFragment([]byte(in), map[string]string{"TENANT": "t1", "PLAN": "pro"})); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaTransport is a Transport over Kafka. Commands go to --kafka-topic and are
+// read by all replicas in a single consumer group, one command at a time per
+// partition, so commands are spread across the topic's partitions (have at least
+// as many as replicas). Topics (reports and progress, named as --report-pubsub and
+// --scenario-pubsub) are plain topics, read by a consumer group per subscriber
+// group, or partition by partition for watchers. All messages are the same JSON as
+// over Pub/Sub, keyed by run ID, so a run's messages stay in order in a single
+// partition. A message a group fails to handle kafkaMaxAttempts times is moved to
+// the '<topic>-dead' topic, so it doesn't block its partition.
+type kafkaTransport struct {
+	brokers     []string
+	topic       string // commands
+	reportTopic string // optional
+	cmds        kafkaWriter
+	reports     kafkaWriter // nil if no report topic
+}
+
+// kafkaWriter is the part of *kafka.Writer we use, i.e. for tests.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// kafkaReader is the part of *kafka.Reader we use to consume in a group.
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// How many times a message is handled before it's dead-lettered, see read.
+const kafkaMaxAttempts = 5
+
+func newKafkaTransport(brokers []string, topic, reportTopic string) (*kafkaTransport, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, fmt.Errorf("kafka: brokers and topic are required")
+	}
+
+	t := &kafkaTransport{
+		brokers:     brokers,
+		topic:       topic,
+		reportTopic: reportTopic,
+		cmds:        newKafkaWriter(brokers, topic),
+	}
+
+	if reportTopic != "" {
+		t.reports = newKafkaWriter(brokers, reportTopic)
+	}
+
+	return t, nil
+}
+
+func newKafkaWriter(brokers []string, topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(brokers...),
+		Topic:                  topic,
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// kafkaKey returns the message key for data: its run ID, if it has one, else key.
+func kafkaKey(key string, data interface{}) string {
+	var id string
+	switch v := data.(type) {
+	case cmd:
+		id = v.ID
+	case ReportPubsub:
+		id = v.RunID
+	case ScenarioProgressMessage:
+		id = v.RunID
+	}
+
+	if id != "" {
+		return id
+	}
+
+	return key
+}
+
+func kafkaWrite(w kafkaWriter, key string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return w.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(kafkaKey(key, data)),
+		Value: b,
+	})
+}
+
+func (t *kafkaTransport) Name() string { return fmt.Sprintf("kafka=%v", t.topic) }
+
+func (t *kafkaTransport) PublishCommand(c cmd) error {
+	return kafkaWrite(t.cmds, uniuri.NewLen(10), c)
+}
+
+// Subscribe starts from the oldest command for a new group, so commands published
+// before the first replica starts are not lost.
+func (t *kafkaTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	return t.consume(ctx, t.topic, t.topic+"-workers", kafka.FirstOffset, nil, handler)
+}
+
+func (t *kafkaTransport) PublishReport(r ReportPubsub) error {
+	if t.reports == nil {
+		return nil
+	}
+
+	return kafkaWrite(t.reports, r.MessageID, r)
+}
+
+type kafkaPublisher struct{ w kafkaWriter }
+
+func (p kafkaPublisher) Publish(key string, data interface{}) error {
+	return kafkaWrite(p.w, key, data)
+}
+
+func (t *kafkaTransport) Publisher(topic string) (publisher, error) {
+	return kafkaPublisher{w: newKafkaWriter(t.brokers, topic)}, nil
+}
+
+// SubscribeTopic reads topic in the consumer group named group, starting from
+// the latest message for a new group. For an empty group, it reads each partition
+// directly from its last offset at the time of the call, without a group.
+func (t *kafkaTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	if group == "" {
+		return t.watch(ctx, topic, ready, handler)
+	}
+
+	return t.consume(ctx, topic, group, kafka.LastOffset, ready, handler)
+}
+
+// watch calls handler for each message published to topic from now on, until
+// ctx is done. Unlike a new consumer group, which only resolves its offsets once
+// it has joined, the offsets are known before ready is called.
+func (t *kafkaTransport) watch(ctx context.Context, topic string, ready func(), handler func(data []byte) error) error {
+	offsets, err := t.lastOffsets(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	signalReady(ready)
+	var mtx sync.Mutex // one message at a time, as the other transports
+	var wg sync.WaitGroup
+	for p, offset := range offsets {
+		wg.Add(1)
+		go func(p int, offset int64) {
+			defer wg.Done()
+			r := kafka.NewReader(kafka.ReaderConfig{
+				Brokers:   t.brokers,
+				Topic:     topic,
+				Partition: p,
+				MaxWait:   time.Second * 5,
+			})
+
+			defer r.Close()
+			if err := r.SetOffset(offset); err != nil {
+				log.Printf("kafka: %v/%v: set offset failed: %v", topic, p, err)
+				return
+			}
+
+			for {
+				m, err := r.ReadMessage(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("kafka: %v/%v: read failed: %v", topic, p, err)
+					}
+
+					return
+				}
+
+				mtx.Lock()
+				handler(m.Value)
+				mtx.Unlock()
+			}
+		}(p, offset)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// lastOffsets returns the last offset of each partition of topic. Looking up a
+// topic that doesn't exist yet creates it, if the brokers allow it (as for the
+// writers), so it's retried until its partitions are ready or ctx is done.
+func (t *kafkaTransport) lastOffsets(ctx context.Context, topic string) (map[int]int64, error) {
+	d := &kafka.Dialer{Timeout: time.Second * 10}
+	var parts []kafka.Partition
+	for {
+		var err error
+		for _, b := range t.brokers {
+			parts, err = d.LookupPartitions(ctx, "tcp", b, topic)
+			if err == nil {
+				break
+			}
+		}
+
+		if err == nil && len(parts) > 0 {
+			break
+		}
+
+		log.Printf("kafka: %v: waiting for partitions: %v", topic, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	offsets := make(map[int]int64)
+	for _, p := range parts {
+		conn, err := d.DialLeader(ctx, "tcp", net.JoinHostPort(p.Leader.Host, strconv.Itoa(p.Leader.Port)), topic, p.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "kafka: leader of %v/%v", topic, p.ID)
+		}
+
+		offsets[p.ID], err = conn.ReadLastOffset()
+		conn.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "kafka: last offset of %v/%v", topic, p.ID)
+		}
+	}
+
+	return offsets, nil
+}
+
+// consume calls handler for each message of topic, one at a time, as a member of
+// consumer group, until ctx is done, and ready (if not nil) right away. A message's offset is committed only after
+// handler succeeds; if it fails, the reader is reopened from the last committed
+// offset, so the message is redelivered, up to kafkaMaxAttempts times.
+func (t *kafkaTransport) consume(ctx context.Context, topic, group string, start int64, ready func(), handler func(data []byte) error) error {
+	signalReady(ready) // the group's offsets are kept once it has joined
+	failures := make(map[kafkaOffset]int)
+	dead := newKafkaWriter(t.brokers, topic+"-dead")
+	defer dead.Close()
+	for ctx.Err() == nil {
+		r := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     t.brokers,
+			Topic:       topic,
+			GroupID:     group,
+			StartOffset: start,
+			MaxWait:     time.Second * 5,
+		})
+
+		err := t.read(ctx, r, failures, dead, handler)
+		r.Close()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("kafka: %v/%v: %v, reopening", topic, group, err)
+			time.Sleep(time.Second * 5)
+		}
+	}
+
+	return nil
+}
+
+// kafkaDeadLetter writes m, with the error of its last attempt, to w.
+func kafkaDeadLetter(w kafkaWriter, m kafka.Message, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return w.WriteMessages(ctx, kafka.Message{
+		Key:   m.Key,
+		Value: m.Value,
+		Headers: []kafka.Header{
+			{Key: "oops-source", Value: []byte(fmt.Sprintf("%v/%v/%v", m.Topic, m.Partition, m.Offset))},
+			{Key: "oops-error", Value: []byte(cause.Error())},
+		},
+	})
+}
+
+// kafkaOffset is a message's {partition, offset}.
+type kafkaOffset [2]int64
+
+// read calls handler for each message of r, committing it once handled, until ctx
+// is done or handler fails. failures counts the failed attempts of the messages
+// across reads; once a message has failed kafkaMaxAttempts times, it's written to
+// dead, and committed.
+func (t *kafkaTransport) read(ctx context.Context, r kafkaReader, failures map[kafkaOffset]int, dead kafkaWriter, handler func(data []byte) error) error {
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+
+			return errors.Wrap(err, "fetch failed")
+		}
+
+		k := kafkaOffset{int64(m.Partition), m.Offset}
+		if err := handler(m.Value); err != nil {
+			failures[k]++
+			if failures[k] < kafkaMaxAttempts {
+				return errors.Wrapf(err, "offset %v/%v: handler failed, will be redelivered", m.Partition, m.Offset)
+			}
+
+			log.Printf("kafka: offset %v/%v: handler failed %d times, dead-lettered: %v", m.Partition, m.Offset, failures[k], err)
+			if err := kafkaDeadLetter(dead, m, err); err != nil {
+				log.Printf("kafka: offset %v/%v: dead-letter failed, dropped: %v", m.Partition, m.Offset, err)
+			}
+		}
+
+		delete(failures, k)
+
+		// Not ctx: a handled message is committed even if we're stopping.
+		cctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err = r.CommitMessages(cctx, m)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "commit %v/%v failed", m.Partition, m.Offset)
+		}
+	}
+}
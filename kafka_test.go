@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func Test__kafkaKey(t *testing.T) {
+	for _, tc := range []struct {
+		data interface{}
+		want string
+	}{
+		{cmd{Code: "process", ID: "run1", Scenario: "s.yaml"}, "run1"},
+		{cmd{Code: "cancel", ID: "run1"}, "run1"},
+		{ReportPubsub{RunID: "run2", MessageID: "m1"}, "run2"},
+		{ScenarioProgressMessage{RunID: "run3"}, "run3"},
+		{cmd{Code: "start"}, "key"},
+		{map[string]string{"run_id": "x"}, "key"},
+	} {
+		if got := kafkaKey("key", tc.data); got != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.data, got, tc.want)
+		}
+	}
+}
+
+// fakeKafkaWriter records the written messages.
+type fakeKafkaWriter struct {
+	mtx  sync.Mutex
+	msgs []kafka.Message
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+// fakeKafkaPartition is a single partition, read by a group, that keeps the
+// committed offset across readers, as a broker does.
+type fakeKafkaPartition struct {
+	msgs      []kafka.Message
+	committed int64 // next offset to read
+}
+
+// reader returns a reader from the committed offset, i.e. a reopened reader.
+func (p *fakeKafkaPartition) reader() *fakeKafkaReader {
+	return &fakeKafkaReader{p: p, next: p.committed}
+}
+
+type fakeKafkaReader struct {
+	p    *fakeKafkaPartition
+	next int64
+}
+
+// FetchMessage blocks until ctx is done once all messages are read.
+func (r *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.next >= int64(len(r.p.msgs)) {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+
+	m := r.p.msgs[r.next]
+	r.next++
+	return m, nil
+}
+
+func (r *fakeKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, m := range msgs {
+		r.p.committed = m.Offset + 1
+	}
+
+	return nil
+}
+
+func Test__kafkaTransport(t *testing.T) {
+	cmds, reports := &fakeKafkaWriter{}, &fakeKafkaWriter{}
+	tr := &kafkaTransport{topic: "oops", cmds: cmds, reports: reports}
+
+	// A run's messages are keyed by its run ID, to keep them in order.
+	tr.PublishCommand(cmd{Code: "process", ID: "run1", Scenario: "a.yaml"})
+	tr.PublishCommand(cmd{Code: "process", ID: "run1", Scenario: "b.yaml"})
+	tr.PublishReport(ReportPubsub{RunID: "run1", MessageID: "m1", Scenario: "a.yaml"})
+	var keys []string
+	for _, m := range append(cmds.msgs, reports.msgs...) {
+		keys = append(keys, string(m.Key))
+	}
+
+	if fmt.Sprint(keys) != "[run1 run1 run1]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// The offset of a message is committed only once handled: a failed message
+	// is read again by the reopened reader, and the handled ones aren't.
+	p := &fakeKafkaPartition{}
+	for i, m := range cmds.msgs {
+		m.Offset = int64(i)
+		p.msgs = append(p.msgs, m)
+	}
+
+	var handled []string
+	fail := true
+	handler := func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		if c.Scenario == "b.yaml" && fail {
+			fail = false
+			return fmt.Errorf("retry me")
+		}
+
+		handled = append(handled, c.Scenario)
+		return nil
+	}
+
+	failures, dead := make(map[kafkaOffset]int), &fakeKafkaWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := tr.read(ctx, p.reader(), failures, dead, handler); err == nil {
+		t.Fatal("expected the handler's error")
+	}
+
+	if p.committed != 1 {
+		t.Fatalf("expected a.yaml committed, got offset %v", p.committed)
+	}
+
+	cancel()
+	if err := tr.read(ctx, p.reader(), failures, dead, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(handled) != "[a.yaml b.yaml]" || p.committed != 2 {
+		t.Fatalf("unexpected handled %v, committed %v", handled, p.committed)
+	}
+}
+
+// Test__kafkaDeadLetter checks that a command failing kafkaMaxAttempts times is
+// dead-lettered and committed, so the next ones in its partition are handled.
+func Test__kafkaDeadLetter(t *testing.T) {
+	tr := &kafkaTransport{topic: "oops"}
+	p := &fakeKafkaPartition{}
+	for i, s := range []string{"bad.yaml", "ok.yaml"} {
+		b, _ := json.Marshal(cmd{Code: "process", ID: "run1", Scenario: s})
+		p.msgs = append(p.msgs, kafka.Message{Topic: "oops", Offset: int64(i), Key: []byte("run1"), Value: b})
+	}
+
+	var handled []string
+	handler := func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		if c.Scenario == "bad.yaml" {
+			return fmt.Errorf("always fails")
+		}
+
+		handled = append(handled, c.Scenario)
+		return nil
+	}
+
+	failures, dead := make(map[kafkaOffset]int), &fakeKafkaWriter{}
+	for i := 1; i < kafkaMaxAttempts; i++ {
+		if err := tr.read(context.Background(), p.reader(), failures, dead, handler); err == nil {
+			t.Fatalf("attempt %v: expected the handler's error", i)
+		}
+	}
+
+	if p.committed != 0 || len(dead.msgs) != 0 {
+		t.Fatalf("dead-lettered too early, committed %v", p.committed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tr.read(ctx, p.reader(), failures, dead, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dead.msgs) != 1 || string(dead.msgs[0].Key) != "run1" {
+		t.Fatalf("expected bad.yaml dead-lettered, got %v", dead.msgs)
+	}
+
+	if fmt.Sprint(handled) != "[ok.yaml]" || p.committed != 2 || len(failures) != 0 {
+		t.Fatalf("unexpected handled %v, committed %v, failures %v", handled, p.committed, failures)
+	}
+}
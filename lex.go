@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// exprToken is a lexical token of an expression, see exprLexer.
+type exprToken struct {
+	op  string // one of the lexer's ops, empty for values
+	val string
+	lit bool // quoted string, or a literal per the expression; never a name
+}
+
+// exprLexer splits an expression into its ops (longest first), quoted strings
+// and words, i.e. runs of the runes for which word returns true. Spaces only
+// separate tokens; any other rune is an error.
+type exprLexer struct {
+	ops  []string
+	word func(c rune) bool
+}
+
+// op returns the longest op r starts with, or "".
+func (l exprLexer) op(r []rune) string {
+	var longest string
+	for _, op := range l.ops {
+		n := len([]rune(op))
+		if n <= len(r) && n > len([]rune(longest)) && string(r[:n]) == op {
+			longest = op
+		}
+	}
+
+	return longest
+}
+
+func (l exprLexer) lex(expr string) ([]exprToken, error) {
+	var out []exprToken
+	r := []rune(expr)
+	for i := 0; i < len(r); {
+		c := r[i]
+		if op := l.op(r[i:]); op != "" {
+			out = append(out, exprToken{op: op})
+			i += len([]rune(op))
+			continue
+		}
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(r) && r[j] != c {
+				j++
+			}
+
+			if j >= len(r) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+
+			out = append(out, exprToken{val: string(r[i+1 : j]), lit: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(r) && l.word(r[j]) {
+				j++
+			}
+
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+
+			out = append(out, exprToken{val: string(r[i:j])})
+			i = j
+		}
+	}
+
+	return out, nil
+}
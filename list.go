@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// scenarioSelection is a scenario file (or variant) considered for distribution,
+// and why it was included or excluded.
+type scenarioSelection struct {
+	File     string `json:"file"`
+	Included bool   `json:"included"`
+	Reason   string `json:"reason"`
+}
+
+// selectScenarios runs the same selection as the 'start' and 'start_all' commands:
+// discovery, affected services (unless forceAll), overlay dedupe, tags, then
+// matrix/data expansion. It returns every file considered, included or not. The
+// returned bool is false if nothing can be selected because metadata has no
+// affected services, and the error is set if tagFilters are invalid.
+func selectScenarios(tagFilters []string, metadata map[string]interface{}, forceAll bool) ([]scenarioSelection, bool, error) {
+	var out []scenarioSelection
+	exclude := func(f, reason string) {
+		out = append(out, scenarioSelection{File: f, Reason: reason})
+	}
+
+	discovered := combineFilesAndDir()
+	final := discovered
+	reasons := make(map[string]string) // why included, per file
+	if forceAll {
+		for _, f := range final {
+			reasons[f] = "start_all"
+		}
+	} else {
+		affectedServices := extractAffectedServices(metadata)
+		if len(affectedServices) == 0 {
+			log.Printf("no affected services in metadata, skipping distribution")
+			for _, f := range final {
+				exclude(f, "no affected services in metadata")
+			}
+
+			return out, false, nil
+		}
+
+		log.Printf("affected services from metadata: %v", affectedServices)
+		before := len(final)
+		final = filterScenariosByAffectedServices(final, affectedServices)
+		log.Printf("service filter: %d/%d scenarios kept", len(final), before)
+		for _, f := range final {
+			reasons[f] = "affected service " + affectedService(f, affectedServices)
+		}
+
+		for _, f := range discovered {
+			if _, ok := reasons[f]; !ok {
+				exclude(f, fmt.Sprintf("not in affected services %v", affectedServices))
+			}
+		}
+	}
+
+	// If hook returned an overlay_dir, scan it and drop baked-in files
+	// that have an overlay counterpart at the same relative path.
+	overlayDir, _ := metadata["overlay_dir"].(string)
+	if overlayDir != "" {
+		deduped := dedupeWithOverlay(overlayDir, final)
+		kept := make(map[string]bool)
+		for _, f := range deduped {
+			kept[f] = true
+			if _, ok := reasons[f]; !ok {
+				reasons[f] = "overlay"
+			}
+		}
+
+		for _, f := range final {
+			if !kept[f] {
+				exclude(f, "overridden by overlay in "+overlayDir)
+			}
+		}
+
+		final = deduped
+	}
+
+	filtered, err := filterScenariosByTags(final, tagFilters)
+	if err != nil {
+		return nil, false, err
+	}
+
+	log.Printf("distributing %d/%d scenarios matching tags %v", len(filtered), len(final), tagFilters)
+	matched := make(map[string]bool)
+	for _, f := range filtered {
+		matched[f] = true
+	}
+
+	for _, f := range final {
+		if !matched[f] {
+			exclude(f, fmt.Sprintf("tags %v do not match", tagFilters))
+		}
+	}
+
+	var variants int
+	for _, f := range filtered {
+		reason := reasons[f]
+		if len(tagFilters) > 0 {
+			reason += fmt.Sprintf(", tags %v", tagFilters)
+		}
+
+		for _, v := range expandVariants([]string{f}) {
+			variants++
+			out = append(out, scenarioSelection{File: v, Included: true, Reason: reason})
+		}
+	}
+
+	log.Printf("%d scenario variants after matrix/data expansion", variants)
+	return out, true, nil
+}
+
+// includedScenarios returns the files (or variants) to distribute from sel.
+func includedScenarios(sel []scenarioSelection) []string {
+	var out []string
+	for _, s := range sel {
+		if s.Included {
+			out = append(out, s.File)
+		}
+	}
+
+	return out
+}
+
+// affectedService returns the first affected service that file belongs to, as
+// per filterScenariosByAffectedServices.
+func affectedService(file string, affectedServices []string) string {
+	for _, part := range strings.Split(filepath.ToSlash(file), "/") {
+		for _, s := range affectedServices {
+			if strings.EqualFold(part, strings.TrimSpace(s)) {
+				return s
+			}
+		}
+	}
+
+	return ""
+}
+
+// printSelection writes sel to w as a table, or as JSON if output is 'json'.
+func printSelection(w io.Writer, sel []scenarioSelection, output string) error {
+	switch output {
+	case "json":
+		var n int
+		for _, s := range sel {
+			if s.Included {
+				n++
+			}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]interface{}{
+			"total_scenarios": n,
+			"scenarios":       sel,
+		})
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATUS\tSCENARIO\tREASON")
+		var n int
+		for _, s := range sel {
+			status := "excluded"
+			if s.Included {
+				status = "included"
+				n++
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", status, s.File, s.Reason)
+		}
+
+		fmt.Fprintf(tw, "\ntotal_scenarios: %d\n", n)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown --output %q, expecting table or json", output)
+	}
+}
+
+func listCmd() *cobra.Command {
+	var (
+		metadataFile string
+		affected     []string
+		overlayDir   string
+		all          bool
+		output       string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "Preview which scenarios a run would distribute",
+		Long: `Preview which scenarios a 'start' (or 'start_all' with --all) command would
+distribute, and why each discovered file is included or excluded. Uses the same
+--dir, discovery and --tags flags as the other commands.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			log.SetOutput(os.Stderr) // keep stdout clean for the output
+			if _, err := parseTags(tags); err != nil {
+				return err
+			}
+
+			metadata, err := readMetadata(metadataFile)
+			if err != nil {
+				return err
+			}
+
+			if len(affected) > 0 {
+				ta, _ := metadata["test_analysis"].(map[string]interface{})
+				if ta == nil {
+					ta = make(map[string]interface{})
+				}
+
+				ta["affected_services"] = strings.Join(affected, ",")
+				for _, k := range []string{"affected_cloudrun", "affected_microapps", "affected_serverless", "affected_packages", "affected_commands"} {
+					delete(ta, k)
+				}
+
+				metadata["test_analysis"] = ta
+			}
+
+			if overlayDir != "" {
+				metadata["overlay_dir"] = overlayDir
+			}
+
+			sel, _, err := selectScenarios(tags, metadata, all)
+			if err != nil {
+				return err
+			}
+
+			return printSelection(os.Stdout, sel, output)
+		},
+	}
+
+	cmd.Flags().SortFlags = false
+	cmd.Flags().StringVar(&metadataFile, "metadata", metadataFile, "JSON file ('-' for stdin) with the run metadata, i.e. test_analysis.affected_services, overlay_dir")
+	cmd.Flags().StringSliceVar(&affected, "affected-services", affected, "affected services, overrides the ones in --metadata")
+	cmd.Flags().StringVar(&overlayDir, "overlay-dir", overlayDir, "overlay dir, overrides overlay_dir in --metadata")
+	cmd.Flags().BoolVar(&all, "all", all, "preview 'start_all' (no affected services filter)")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "output format: table, json")
+	return cmd
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func Test__selectScenarios(t *testing.T) {
+	root := t.TempDir()
+	overlay := t.TempDir()
+	writeTestFile(t, root, "services/billing/scenarios/01.yaml", "tags: {env: dev}")
+	writeTestFile(t, root, "services/billing/scenarios/02.yaml", "tags: {env: prod}")
+	writeTestFile(t, root, "services/billing/scenarios/03.yaml", "tags: {env: dev}\nmatrix: {region: [us, jp]}")
+	writeTestFile(t, root, "services/users/scenarios/01.yaml", "tags: {env: dev}")
+	writeTestFile(t, overlay, "services/billing/scenarios/01.yaml", "tags: {env: dev}")
+
+	defer func(d string) { dir = d }(dir)
+	dir = root
+	metadata := map[string]interface{}{
+		"test_analysis": map[string]interface{}{"affected_services": "billing"},
+		"overlay_dir":   overlay,
+	}
+
+	sel, ok, err := selectScenarios([]string{"env=dev"}, metadata, false)
+	if err != nil || !ok {
+		t.Fatal("expected ok", err)
+	}
+
+	got := make(map[string]scenarioSelection)
+	for _, s := range sel {
+		got[s.File] = s
+	}
+
+	for _, tc := range []struct {
+		file     string
+		included bool
+		reason   string
+	}{
+		{filepath.Join(root, "services/users/scenarios/01.yaml"), false, "not in affected services [billing]"},
+		{filepath.Join(root, "services/billing/scenarios/01.yaml"), false, "overridden by overlay in " + overlay},
+		{filepath.Join(root, "services/billing/scenarios/02.yaml"), false, "tags [env=dev] do not match"},
+		{filepath.Join(root, "services/billing/scenarios/03.yaml[region=us]"), true, "affected service billing, tags [env=dev]"},
+		{filepath.Join(root, "services/billing/scenarios/03.yaml[region=jp]"), true, "affected service billing, tags [env=dev]"},
+		{filepath.Join(overlay, "services/billing/scenarios/01.yaml"), true, "overlay, tags [env=dev]"},
+	} {
+		s, ok := got[tc.file]
+		if !ok || s.Included != tc.included || s.Reason != tc.reason {
+			t.Errorf("%v: expected %v/%q, got %+v", tc.file, tc.included, tc.reason, s)
+		}
+	}
+
+	if len(includedScenarios(sel)) != 3 {
+		t.Fatalf("expected 3 included, got %v", includedScenarios(sel))
+	}
+
+	var buf bytes.Buffer
+	if err := printSelection(&buf, sel, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		Total int `json:"total_scenarios"`
+	}
+
+	json.Unmarshal(buf.Bytes(), &out)
+	if out.Total != 3 {
+		t.Fatalf("expected total_scenarios 3, got %v", buf.String())
+	}
+
+	if _, ok, _ := selectScenarios(nil, map[string]interface{}{}, false); ok {
+		t.Fatal("expected not ok without affected services")
+	}
+
+	if _, _, err := selectScenarios([]string{"env=("}, metadata, false); err == nil {
+		t.Fatal("expected an error for invalid tags")
+	}
+}
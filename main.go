@@ -9,21 +9,16 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"cloud.google.com/go/spanner"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sns"
-	"github.com/dchest/uniuri"
-	lssqs "github.com/flowerinthenight/longsub/awssqs"
-	lspubsub "github.com/flowerinthenight/longsub/gcppubsub"
 	yaml "github.com/goccy/go-yaml"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -38,36 +33,75 @@ var (
 	project string
 	pubsub  string
 
-	region  string
-	key     string
-	secret  string
-	rolearn string
-	snssqs  string
+	region     string
+	key        string
+	secret     string
+	rolearn    string
+	awsprofile string
+	snssqs     string
 
 	files []string
 	dir   string
 	tags  []string
 
+	retries    int
+	tagretries []string
+	retryRules []retryRule // parsed from tagretries, see parseTagRetries
+
+	quarantinefile         string
+	spannerquarantinetable string
+
+	discoverylayout  string
+	discoveryinclude []string
+	discoveryexclude []string
+	followsymlinks   bool
+
 	repslack  string
 	reppubsub string
 
+	natsurl    string
+	natsstream string
+
+	redisurl    string
+	redisstream string
+
+	kafkabrokers string
+	kafkatopic   string
+
 	scenariopubsub     string
 	githubtoken        string
 	secretproject      string
 	secretname         string
 	spannerdb          string
 	spannercanceltable string
+	cancelstore        string
+	cancelurl          string
+	canceltable        string
+	cancelpubsub       string
+	cancelrefresh      time.Duration
+	apiaddr            string
+	apitoken           string
+	apitlscert         string
+	apitlskey          string
+	apiclientca        string
 	preprocesshook     string
 	skipNotif          bool
+	shutdowngrace      time.Duration
+	aggregate          bool
+	resultstore        string
+	spannerresulttable string
 
 	verbose bool
 )
 
 type cmd struct {
-	// Valid values: start | start_all | process
+	// Valid values: start | start_all | process | rerun_failed | rerun_scenarios | cancel
 	// start = initiate distribution of files in --dir to SNS
 	// start_all = initiate distribution of all files in --dir (tag-filtered only)
 	// process = normal processing (one yaml at a time)
+	// rerun_failed = redistribute the failed scenarios of a prior run (see RerunOf)
+	// rerun_scenarios = redistribute the scenarios in Scenarios, with a prior run's metadata
+	// cancel = record the cancellation of run ID (and/or metadata commit_sha) in --cancel-store
 	Code string `json:"code"`
 
 	// To identify a batch. Sent by the initiator together with
@@ -77,8 +111,9 @@ type cmd struct {
 	// The file to process. Sent together with the 'process' code.
 	Scenario string `json:"scenario"`
 
-	// Optional tags to filter scenarios. Format: ["key=value", "key2=value2"]
-	// When provided with 'start' code, only scenarios matching ALL tags will be distributed.
+	// Optional tag expressions to filter scenarios, i.e. ["env in (dev,stg)", "!slow"].
+	// When provided with 'start' code, only scenarios matching ALL entries will be distributed.
+	// See parseTags for the syntax; plain "key=value" entries work as before.
 	Tags []string `json:"tags,omitempty"`
 
 	// Metadata for cancellation requests
@@ -86,10 +121,26 @@ type cmd struct {
 
 	// Links the original run and all its reruns together.
 	GroupID string `json:"group_id,omitempty"`
+
+	// The prior run to rerun, for the rerun codes. If empty, the latest results
+	// of GroupID are used.
+	RerunOf string `json:"rerun_of,omitempty"`
+
+	// The scenarios to rerun (absolute, or relative to --dir), for 'rerun_scenarios'.
+	Scenarios []string `json:"scenarios,omitempty"`
 }
 
 func runE(cmd *cobra.Command, args []string) error {
-	return doScenario(&doScenarioInput{
+	if _, err := parseTags(tags); err != nil {
+		return err
+	}
+
+	var err error
+	if retryRules, err = parseTagRetries(tagretries); err != nil {
+		return err
+	}
+
+	return doScenario(cmd.Context(), &doScenarioInput{
 		ScenarioFiles: combineFilesAndDir(),
 		ReportSlack:   repslack,
 		ReportPubsub:  reppubsub,
@@ -119,31 +170,24 @@ func combineFilesAndDir() []string {
 	}
 
 	if len(final) == 0 {
-		log.Fatal("No files found. Please recheck directory.")
+		log.Fatalf("No files found. Please recheck directory, or --discovery-layout (%v).", discoverylayout)
 	}
 
-	return final
-}
+	sort.Strings(final)
 
-func findScenarioFiles(root string) []string {
-	var out []string
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && strings.HasSuffix(path, ".yaml") && strings.Contains(path, "/scenarios/") {
-			abs, _ := filepath.Abs(path)
-			log.Printf("input: %v", abs)
-			out = append(out, abs)
-		}
-		return nil
-	})
-	return out
+	return final
 }
 
-func filterScenariosByTags(files []string, tagFilters []string) []string {
+// filterScenariosByTags returns the files whose tags match tagFilters. Invalid
+// filters are an error, rather than matching nothing.
+func filterScenariosByTags(files []string, tagFilters []string) ([]string, error) {
 	if len(tagFilters) == 0 {
-		return files
+		return files, nil
+	}
+
+	match, err := parseTags(tagFilters)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tags %v", tagFilters)
 	}
 
 	var filtered []string
@@ -161,14 +205,14 @@ func filterScenariosByTags(files []string, tagFilters []string) []string {
 			continue
 		}
 
-		if isAllowedWithTags(&s, tagFilters) {
+		if match(s.Tags) {
 			filtered = append(filtered, f)
 		} else {
 			log.Printf("%v filtered out by tags", f)
 		}
 	}
 
-	return filtered
+	return filtered, nil
 }
 
 func dedupeWithOverlay(overlayDir string, scenarios []string) []string {
@@ -191,28 +235,6 @@ func dedupeWithOverlay(overlayDir string, scenarios []string) []string {
 	return out
 }
 
-func isAllowedWithTags(s *Scenario, tagFilters []string) bool {
-	if len(tagFilters) == 0 {
-		return true
-	}
-
-	var matched int
-	for _, t := range tagFilters {
-		tt := strings.Split(t, "=")
-		if len(tt) != 2 {
-			continue
-		}
-
-		for k, v := range s.Tags {
-			if k == tt[0] && v == tt[1] {
-				matched++
-			}
-		}
-	}
-
-	return matched == len(tagFilters)
-}
-
 func extractAffectedServices(metadata map[string]interface{}) []string {
 	ta, ok := metadata["test_analysis"].(map[string]interface{})
 	if !ok {
@@ -271,165 +293,113 @@ func filterScenariosByAffectedServices(files []string, affectedServices []string
 	return out
 }
 
-func distributePubsub(app *appctx, runID string, tagFilters []string, metadata map[string]interface{}, forceAll bool) bool {
-	id := runID
+// distribute selects the scenarios for a start/start_all command, then publishes
+// a 'process' command for each of them. Returns false if nothing was published.
+func distribute(app *appctx, runID, groupID string, tagFilters []string, metadata map[string]interface{}, forceAll bool) bool {
 	if metadata == nil {
 		metadata = make(map[string]interface{})
 	}
-	final := combineFilesAndDir()
-	if !forceAll {
-		affectedServices := extractAffectedServices(metadata)
-		if len(affectedServices) == 0 {
-			log.Printf("no affected services in metadata, skipping distribution")
-			return false
-		}
-
-		log.Printf("affected services from metadata: %v", affectedServices)
-		before := len(final)
-		final = filterScenariosByAffectedServices(final, affectedServices)
-		log.Printf("service filter: %d/%d scenarios kept", len(final), before)
+	sel, ok, err := selectScenarios(tagFilters, metadata, forceAll)
+	if err != nil {
+		log.Printf("distribute: run_id=%s: %v", runID, err)
+		return false
 	}
 
-	// If hook returned an overlay_dir, scan it and drop baked-in files
-	// that have an overlay counterpart at the same relative path.
-	overlayDir, _ := metadata["overlay_dir"].(string)
-	if overlayDir != "" {
-		final = dedupeWithOverlay(overlayDir, final)
+	if !ok {
+		return false
 	}
 
-	filtered := filterScenariosByTags(final, tagFilters)
-	log.Printf("distributing %d/%d scenarios matching tags %v", len(filtered), len(final), tagFilters)
-
-	metadata["total_scenarios"] = fmt.Sprintf("%d", len(filtered))
+	publishProcess(app, includedScenarios(sel), runID, groupID, metadata)
+	return true
+}
 
-	for _, f := range filtered {
+// publishProcess publishes a 'process' command for each of files.
+func publishProcess(app *appctx, files []string, runID, groupID string, metadata map[string]interface{}) {
+	metadata["total_scenarios"] = fmt.Sprintf("%d", len(files))
+	for _, f := range files {
 		nc := cmd{
 			Code:     "process",
-			ID:       id,
+			ID:       runID,
 			Scenario: f,
 			Metadata: metadata,
+			GroupID:  groupID,
 		}
 
-		err := app.pub.Publish(uniuri.NewLen(10), nc)
+		err := app.transport.PublishCommand(nc)
 		if err != nil {
 			log.Printf("publish failed: %v ", err)
 			continue
 		}
 	}
-	return true
 }
 
-func distributeSQS(app *appctx, runID string, tagFilters []string, metadata map[string]interface{}, forceAll bool) bool {
-	sess, _ := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(key, secret, ""),
-	})
-
-	var svc *sns.SNS
-	if rolearn != "" {
-		cnf := &aws.Config{Credentials: stscreds.NewCredentials(sess, rolearn)}
-		svc = sns.New(sess, cnf)
-	} else {
-		svc = sns.New(sess)
-	}
-
-	id := runID
-	if metadata == nil {
-		metadata = make(map[string]interface{})
-	}
-	final := combineFilesAndDir()
-	if !forceAll {
-		affectedServices := extractAffectedServices(metadata)
-		if len(affectedServices) == 0 {
-			log.Printf("no affected services in metadata, skipping distribution")
-			return false
-		}
-
-		log.Printf("affected services from metadata: %v", affectedServices)
-		before := len(final)
-		final = filterScenariosByAffectedServices(final, affectedServices)
-		log.Printf("service filter: %d/%d scenarios kept", len(final), before)
-	}
-
-	// If hook returned an overlay_dir, scan it and drop baked-in files
-	// that have an overlay counterpart at the same relative path.
-	overlayDir, _ := metadata["overlay_dir"].(string)
-	if overlayDir != "" {
-		final = dedupeWithOverlay(overlayDir, final)
-	}
-
-	filtered := filterScenariosByTags(final, tagFilters)
-	log.Printf("distributing %d/%d scenarios matching tags %v", len(filtered), len(final), tagFilters)
-	metadata["total_scenarios"] = fmt.Sprintf("%d", len(filtered))
+type appctx struct {
+	ctx           context.Context // service context, done on shutdown
+	transport     Transport       // commands and reports, see newTransport
+	mtx           *sync.Mutex
+	spannerClient *spanner.Client // for --spanner-db tables, i.e. cancels, results
+	cancels       CancelStore     // nil if none, see --cancel-store
+	cancelWatch   *cancelWatcher  // nil if not running as a service
+	cancelPub     publisher       // nil if no --cancel-pubsub
+	inflight      atomic.Int32    // scenarios currently running, see waitInflight
+	suites        *suiteCache     // suite.yaml setups, for the lifetime of the service
+	results       resultStore     // per-run scenario results, see --result-store
+	quarantine    *quarantineList // see --quarantine-file, --spanner-quarantine-table
+}
 
-	for _, f := range filtered {
-		nc := cmd{
-			Code:     "process",
-			ID:       id,
-			Scenario: f,
-			Metadata: metadata,
-		}
+// stopping returns true if the service is shutting down.
+func (a *appctx) stopping() bool {
+	return a.ctx != nil && a.ctx.Err() != nil
+}
 
-		b, _ := json.Marshal(nc)
-		key := uniuri.NewLen(10)
-		m := &sns.PublishInput{
-			TopicArn: app.topicArn,
-			Subject:  &key,
-			Message:  aws.String(string(b)),
+// waitInflight waits for running scenarios (and their cleanup) to finish, up
+// to timeout.
+func (a *appctx) waitInflight(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for a.inflight.Load() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("WARNING: scenarios still running after %v, exiting anyway", timeout)
+			return
 		}
 
-		_, err := svc.Publish(m)
-		if err != nil {
-			log.Printf("Publish failed: %v", err)
-			continue
-		}
+		time.Sleep(time.Millisecond * 100)
 	}
-	return true
-}
-
-type appctx struct {
-	pub           *lspubsub.PubsubPublisher // starter publisher topic
-	rpub          *lspubsub.PubsubPublisher // topic to publish reports
-	mtx           *sync.Mutex
-	topicArn      *string
-	spannerClient *spanner.Client // Spanner client for cross-pod cancel lookup
 }
 
+// isRunCancelled returns true if run runID or commitSha is cancelled in the
+// cancel store. Lookup errors are logged, and not treated as cancelled.
 func (a *appctx) isRunCancelled(runID string, commitSha string) bool {
 	if runID == "" && commitSha == "" {
 		return false
 	}
 
-	if a.spannerClient == nil {
+	if a.cancelWatch != nil {
+		return a.cancelWatch.Cancelled(runID, commitSha)
+	}
+
+	if a.cancels == nil {
 		return false
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	cancelled, err := a.cancels.Cancelled(ctx, runID, commitSha)
+	if err != nil {
+		log.Printf("isRunCancelled: run_id=%s commit_sha=%s: %v", runID, commitSha, err)
+		return false
+	}
 
-	var stmt spanner.Statement
-	if runID != "" {
-		stmt = spanner.Statement{
-			SQL: fmt.Sprintf(`SELECT run_id FROM %s WHERE run_id = @run_id AND status = 'closed' LIMIT 1`, spannercanceltable),
-			Params: map[string]interface{}{
-				"run_id": runID,
-			},
-		}
-	} else {
-		stmt = spanner.Statement{
-			SQL: fmt.Sprintf(`SELECT run_id FROM %s WHERE commit_sha = @commit_sha AND status = 'closed' LIMIT 1`, spannercanceltable),
-			Params: map[string]interface{}{
-				"commit_sha": commitSha,
-			},
-		}
+	return cancelled
+}
+
+// watchRun returns a context derived from ctx that is cancelled as soon as run
+// runID or commitSha is, and a function to call when done with it.
+func (a *appctx) watchRun(ctx context.Context, runID, commitSha string) (context.Context, func()) {
+	if a.cancelWatch == nil {
+		return context.WithCancel(ctx)
 	}
 
-	found := false
-	_ = a.spannerClient.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
-		found = true
-		return nil
-	})
-	return found
+	return a.cancelWatch.watch(ctx, runID, commitSha)
 }
 
 func handleScenarioCompletion(ctx any, data []byte) error {
@@ -533,6 +503,14 @@ func process(ctx any, data []byte) error {
 		}
 	}
 
+	switch c.Code {
+	case "start", "start_all":
+		if _, err := parseTags(c.Tags); err != nil {
+			log.Printf("%v: rejecting run_id=%s, invalid tags %v: %v", c.Code, c.ID, c.Tags, err)
+			return nil // not retried
+		}
+	}
+
 	switch c.Code {
 	case "start":
 		log.Printf("received start command with tags: %v", c.Tags)
@@ -580,47 +558,30 @@ func process(ctx any, data []byte) error {
 			break
 		}
 
-		var distributed bool
-		var dist string
-		switch {
-		case pubsub != "":
-			distributed = distributePubsub(app, c.ID, c.Tags, c.Metadata, false)
-			dist = fmt.Sprintf("pubsub=%v", pubsub)
-		case snssqs != "":
-			distributed = distributeSQS(app, c.ID, c.Tags, c.Metadata, false)
-			dist = fmt.Sprintf("sns/sqs=%v", snssqs)
-		}
-
-		if !distributed {
+		if !distribute(app, c.ID, c.GroupID, c.Tags, c.Metadata, false) {
 			log.Printf("no scenarios distributed, skipping slack notification")
 			break
 		}
 
 		host, _ := os.Hostname()
 		if repslack != "" {
-			notifyRunStarted("Start tests", host, dist, c.Metadata["trigger_type"].(string), repslack, c.Tags)
+			notifyRunStarted("Start tests", host, app.transport.Name(), c.Metadata["trigger_type"].(string), repslack, c.Tags)
 		}
 	case "start_all":
 		log.Printf("received start_all command with tags: %v", c.Tags)
-		var distributed bool
-		var dist string
-		switch {
-		case pubsub != "":
-			distributed = distributePubsub(app, c.ID, c.Tags, c.Metadata, true)
-			dist = fmt.Sprintf("pubsub=%v", pubsub)
-		case snssqs != "":
-			distributed = distributeSQS(app, c.ID, c.Tags, c.Metadata, true)
-			dist = fmt.Sprintf("sns/sqs=%v", snssqs)
-		}
-
-		if !distributed {
+		if !distribute(app, c.ID, c.GroupID, c.Tags, c.Metadata, true) {
 			log.Printf("no scenarios distributed, skipping slack notification")
 			break
 		}
 
 		host, _ := os.Hostname()
 		if repslack != "" {
-			notifyRunStarted("Start all tests", host, dist, c.Metadata["trigger_type"].(string), repslack, c.Tags)
+			notifyRunStarted("Start all tests", host, app.transport.Name(), c.Metadata["trigger_type"].(string), repslack, c.Tags)
+		}
+	case "rerun_failed", "rerun_scenarios":
+		log.Printf("received %v command: rerun_of=%v group_id=%v", c.Code, c.RerunOf, c.GroupID)
+		if !rerun(app, c) {
+			log.Printf("no scenarios redistributed for %v", c.Code)
 		}
 	case "rerun_started":
 		mode, _ := c.Metadata["rerun_mode"].(string)
@@ -632,9 +593,43 @@ func process(ctx any, data []byte) error {
 		if repslack != "" {
 			notifyRerunStarted(c.ID, mode, rerunTotal, repository, repslack)
 		}
+	case "cancel":
+		commitSha, _ := c.Metadata["commit_sha"].(string)
+		reason, _ := c.Metadata["reason"].(string)
+		if app.cancels == nil && app.cancelPub == nil {
+			log.Printf("cancel: no --cancel-store or --cancel-pubsub, ignoring cancel for run_id=%s commit_sha=%s", c.ID, commitSha)
+			break
+		}
+
+		if app.cancels != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			err := app.cancels.Cancel(ctx, c.ID, commitSha, reason)
+			cancel()
+			if err != nil {
+				log.Printf("cancel: run_id=%s commit_sha=%s failed: %v", c.ID, commitSha, err)
+				return err
+			}
+		}
+
+		if app.cancelWatch != nil {
+			app.cancelWatch.markCancelled(c.ID, commitSha)
+		}
+
+		// Interrupt the run's scenarios running on the other pods.
+		if app.cancelPub != nil {
+			if err := app.cancelPub.Publish(c.ID, c); err != nil {
+				log.Printf("cancel: broadcast on %v failed: %v", cancelpubsub, err)
+				if app.cancels == nil {
+					return err
+				} // else, the pods' refresh will see it in the store
+			}
+		}
+
+		log.Printf("cancel: run_id=%s commit_sha=%s cancelled (%s)", c.ID, commitSha, reason)
 	case "process":
 		log.Printf("process: %+v", c)
-		doScenario(&doScenarioInput{
+		// Not app.ctx: on shutdown, running scenarios get --shutdown-grace to finish.
+		doScenario(context.Background(), &doScenarioInput{
 			app:           app,
 			ScenarioFiles: []string{c.Scenario},
 			ReportSlack:   repslack,
@@ -651,8 +646,12 @@ func process(ctx any, data []byte) error {
 
 func run(ctx context.Context, done chan error) {
 	var err error
-	if snssqs != "" && pubsub != "" {
-		log.Fatal("cannot set both --sns-sqs and --pubsub")
+	if _, err := parseTags(tags); err != nil {
+		log.Fatal(err)
+	}
+
+	if retryRules, err = parseTagRetries(tagretries); err != nil {
+		log.Fatal(err)
 	}
 
 	log.Printf("rootdir: %v", dir)
@@ -664,12 +663,13 @@ func run(ctx context.Context, done chan error) {
 
 	if snssqs != "" {
 		log.Printf("region: %v", region)
-		log.Printf("key: %v", key)
-		log.Printf("rolearn: %v", rolearn)
+		log.Printf("credentials: %v", awsCredentialSource())
 	}
 
 	app := &appctx{
-		mtx: &sync.Mutex{},
+		ctx:    ctx,
+		mtx:    &sync.Mutex{},
+		suites: newSuiteCache(),
 	}
 
 	if spannerdb != "" {
@@ -682,110 +682,135 @@ func run(ctx context.Context, done chan error) {
 			log.Printf("spanner client initialised: %s", spannerdb)
 		}
 	}
+
+	app.cancels, err = newCancelStore(app.spannerClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if app.cancels == nil && cancelpubsub == "" {
+		log.Printf("WARNING: no --cancel-store or --cancel-pubsub, cancel checks will be skipped")
+	}
+
 	ctx0, cancelCtx0 := context.WithCancel(ctx)
 	defer cancelCtx0()
 	done0 := make(chan error, 1)
 
-	switch {
-	case pubsub != "":
-		// Setup reports publisher topic, if provided.
-		if reppubsub != "" {
-			app.rpub, err = lspubsub.NewPubsubPublisher(project, reppubsub)
-			if err != nil {
-				log.Fatalf("create publisher %v failed: %v", reppubsub, err)
-			}
-		}
-
-		// Make sure topic/subscription is created. Only used for creating subscription if needed.
-		_, t, err := lspubsub.GetPublisher(project, pubsub)
-		if err != nil {
-			log.Fatalf("publisher get/create for %v failed: %v", pubsub, err)
-		}
+	app.transport, err = newTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		app.pub, err = lspubsub.NewPubsubPublisher(project, pubsub)
+	if secretproject != "" {
+		val, err := getSecret(ctx, secretproject, secretname)
 		if err != nil {
-			log.Fatalf("create publisher %v failed: %v", pubsub, err)
-		}
-
-		if app.pub == nil {
-			log.Fatalf("fatal error, publisher nil")
+			log.Printf("WARNING: could not fetch %v from Secret Manager: %v", secretname, err)
+		} else {
+			githubtoken = strings.TrimSpace(val)
+			log.Printf("%v loaded from Secret Manager (project=%s)", secretname, secretproject)
 		}
+	}
 
-		_, err = lspubsub.GetSubscription(project, pubsub, t, time.Second*60)
+	app.cancelWatch = newCancelWatcher(app.cancels)
+	go app.cancelWatch.run(ctx0, cancelrefresh)
+	if cancelpubsub != "" {
+		app.cancelPub, err = app.transport.Publisher(cancelpubsub)
 		if err != nil {
-			log.Fatalf("subscription get/create for %v failed: %v", pubsub, err)
+			log.Fatalf("create publisher %v failed: %v", cancelpubsub, err)
 		}
 
+		// No group: every pod sees every cancel.
+		log.Printf("starting cancel watcher on %v", cancelpubsub)
 		go func() {
-			// Messages should be payer level. We will subdivide linked accts to separate messages for
-			// linked-acct-level processing.
-			ls := lspubsub.NewLengthySubscriber(app, project, pubsub, process)
-			err = ls.Start(ctx0, done0)
+			err := app.transport.SubscribeTopic(ctx0, cancelpubsub, "", nil, app.cancelWatch.handleBroadcast)
 			if err != nil {
-				log.Fatalf("listener for export csv failed: %v", err)
+				log.Fatalf("listener for cancels failed: %v", err)
 			}
 		}()
-	case snssqs != "":
-		lsh := lssqs.NewHelper(region, key, secret, rolearn)
-		t, err := lsh.SetupSnsSqsSubscription(snssqs, snssqs)
-		if err != nil {
-			log.Fatal(err)
-		}
+	}
 
-		app.topicArn = t
-		log.Printf("%v subscribed to %v", snssqs, snssqs)
+	if scenariopubsub != "" {
+		if githubtoken == "" {
+			log.Printf("WARNING: githubtoken is empty; scenario progress listener will run, but GitHub repository_dispatch will be skipped")
+		}
+		log.Printf("starting scenario progress listener on %v", scenariopubsub)
 
 		go func() {
-			ls := lssqs.NewLengthySubscriber(app, snssqs, process,
-				lssqs.WithRegion(region),
-				lssqs.WithAccessKeyId(key),
-				lssqs.WithSecretAccessKey(secret),
-				lssqs.WithRoleArn(rolearn),
-			)
-
-			err := ls.Start(ctx0, done0)
+			err := app.transport.SubscribeTopic(ctx0, scenariopubsub, scenariopubsub, nil, func(data []byte) error {
+				return handleScenarioCompletion(app, data)
+			})
+
 			if err != nil {
-				log.Fatalf("start long processing for %v failed: %v", snssqs, err)
+				log.Fatalf("listener for scenario progress failed: %v", err)
 			}
 		}()
 	}
-	if secretproject != "" {
-		val, err := getSecret(ctx, secretproject, secretname)
-		if err != nil {
-			log.Printf("WARNING: could not fetch %v from Secret Manager: %v", secretname, err)
-		} else {
-			githubtoken = strings.TrimSpace(val)
-			log.Printf("%v loaded from Secret Manager (project=%s)", secretname, secretproject)
-		}
+
+	app.quarantine = &quarantineList{client: app.spannerClient}
+	if spannerquarantinetable != "" && app.spannerClient == nil {
+		log.Fatalf("--spanner-quarantine-table needs --spanner-db")
 	}
 
-	if scenariopubsub != "" && pubsub != "" {
-		if githubtoken == "" {
-			log.Printf("WARNING: githubtoken is empty; scenario progress listener will run, but GitHub repository_dispatch will be skipped")
+	switch resultstore {
+	case "memory":
+		app.results = newMemResultStore()
+	case "spanner":
+		if app.spannerClient == nil || spannerresulttable == "" {
+			log.Fatalf("--result-store=spanner needs --spanner-db and --spanner-result-table")
 		}
-		log.Printf("starting scenario progress listener on %v", scenariopubsub)
 
-		_, st, err := lspubsub.GetPublisher(project, scenariopubsub)
-		if err != nil {
-			log.Fatalf("publisher get/create for %v failed: %v", scenariopubsub, err)
+		app.results = &spannerResultStore{client: app.spannerClient, table: spannerresulttable}
+	default:
+		log.Fatalf("unknown --result-store %q, expecting memory or spanner", resultstore)
+	}
+
+	if aggregate {
+		if reppubsub == "" || scenariopubsub == "" {
+			log.Fatalf("--aggregate needs --report-pubsub and --scenario-pubsub")
 		}
 
-		_, err = lspubsub.GetSubscription(project, scenariopubsub, st, time.Second*60)
+		progress, err := app.transport.Publisher(scenariopubsub)
 		if err != nil {
-			log.Fatalf("subscription get/create for %v failed: %v", scenariopubsub, err)
+			log.Fatalf("create publisher %v failed: %v", scenariopubsub, err)
 		}
 
-		done1 := make(chan error, 1)
+		// Shared by all replicas, so each report is aggregated once.
+		group := reppubsub + "-aggregator"
+		log.Printf("starting run aggregator on %v (store=%v)", group, resultstore)
+		agg := &aggregator{store: app.results, pub: progress}
 		go func() {
-			ls := lspubsub.NewLengthySubscriber(app, project, scenariopubsub, handleScenarioCompletion)
-			err := ls.Start(ctx0, done1)
+			err := app.transport.SubscribeTopic(ctx0, reppubsub, group, nil, func(data []byte) error {
+				return agg.handleReport(app, data)
+			})
+
 			if err != nil {
-				log.Fatalf("listener for scenario progress failed: %v", err)
+				log.Fatalf("listener for run aggregator failed: %v", err)
 			}
 		}()
 	}
 
+	if apiaddr != "" {
+		srv, err := newAPIServer(app)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go serveAPI(ctx0, srv)
+	}
+
+	// Last, so the app is fully set up before the first command.
+	go func() {
+		err := app.transport.Subscribe(ctx0, func(data []byte) error { return process(app, data) })
+		if err != nil {
+			log.Fatalf("listener for %v failed: %v", app.transport.Name(), err)
+		}
+
+		done0 <- nil
+	}()
+
 	<-ctx.Done()
+	app.waitInflight(shutdowngrace)
+	app.suites.teardownAll()
 	done <- <-done0
 }
 
@@ -821,7 +846,22 @@ func runCmd() *cobra.Command {
 	cmd.Flags().StringVar(&scenariopubsub, "scenario-pubsub", os.Getenv("SCENARIO_PUBSUB"), "pubsub subscription for scenario progress (e.g. oopsnext-scenarios)")
 	cmd.Flags().StringVar(&spannerdb, "spanner-db", os.Getenv("SPANNER_DB"), "Spanner DB path for cancel checks")
 	cmd.Flags().StringVar(&spannercanceltable, "spanner-cancel-table", os.Getenv("SPANNER_CANCEL_TABLE"), "Spanner table name for cancel checks")
+	cmd.Flags().StringVar(&cancelstore, "cancel-store", os.Getenv("CANCEL_STORE"), "store for cancelled runs: spanner (default if --spanner-cancel-table is set), postgres, redis, http, file")
+	cmd.Flags().StringVar(&cancelurl, "cancel-url", os.Getenv("CANCEL_URL"), "postgres DSN, redis URL, HTTP endpoint or file path, for --cancel-store")
+	cmd.Flags().StringVar(&canceltable, "cancel-table", "oops_cancels", "table name for --cancel-store=postgres")
+	cmd.Flags().StringVar(&cancelpubsub, "cancel-pubsub", os.Getenv("CANCEL_PUBSUB"), "topic to broadcast 'cancel' commands to all pods, interrupting running scenarios")
+	cmd.Flags().DurationVar(&cancelrefresh, "cancel-refresh", time.Second*15, "how often running runs are looked up again in --cancel-store")
 	cmd.Flags().BoolVar(&skipNotif, "skip-result-notif", false, "skip result Slack notification")
+	cmd.Flags().BoolVar(&aggregate, "aggregate", aggregate, "aggregate --report-pubsub reports per run, publish progress and 'completed' messages to --scenario-pubsub")
+	cmd.Flags().StringVar(&resultstore, "result-store", "memory", "store for per-run results: memory (single replica), spanner (needs --spanner-db)")
+	cmd.Flags().StringVar(&spannerquarantinetable, "spanner-quarantine-table", os.Getenv("SPANNER_QUARANTINE_TABLE"), "Spanner table name for quarantined scenarios, in addition to --quarantine-file")
+	cmd.Flags().StringVar(&spannerresulttable, "spanner-result-table", os.Getenv("SPANNER_RESULT_TABLE"), "Spanner table name for --result-store=spanner")
+	cmd.Flags().DurationVar(&shutdowngrace, "shutdown-grace", time.Second*25, "max wait for running scenarios (and their cleanup) on shutdown")
+	cmd.Flags().StringVar(&apiaddr, "api-addr", os.Getenv("API_ADDR"), "address (i.e. :8080) to serve the HTTP control API on, disabled if empty")
+	cmd.Flags().StringVar(&apitoken, "api-token", os.Getenv("API_TOKEN"), "bearer token for the control API")
+	cmd.Flags().StringVar(&apitlscert, "api-tls-cert", os.Getenv("API_TLS_CERT"), "TLS certificate file for the control API")
+	cmd.Flags().StringVar(&apitlskey, "api-tls-key", os.Getenv("API_TLS_KEY"), "TLS key file for the control API")
+	cmd.Flags().StringVar(&apiclientca, "api-client-ca", os.Getenv("API_CLIENT_CA"), "CA file to verify control API client certificates (mTLS), needs --api-tls-cert")
 	return cmd
 }
 
@@ -832,24 +872,43 @@ func init() {
 	rootcmd.PersistentFlags().StringVar(&secretproject, "secret-project-id", "", "GCP project id where secrets are stored")
 	rootcmd.PersistentFlags().StringVar(&secretname, "secret-name", "", "secret name to fetch from Secret Manager")
 	rootcmd.PersistentFlags().StringVar(&region, "region", os.Getenv("AWS_REGION"), "AWS region")
-	rootcmd.PersistentFlags().StringVar(&key, "aws-key", os.Getenv("AWS_ACCESS_KEY_ID"), "AWS access key")
+	rootcmd.PersistentFlags().StringVar(&key, "aws-key", os.Getenv("AWS_ACCESS_KEY_ID"), "AWS access key, if empty (with --aws-secret), the SDK default credential chain is used")
 	rootcmd.PersistentFlags().StringVar(&secret, "aws-secret", os.Getenv("AWS_SECRET_ACCESS_KEY"), "AWS secret key")
 	rootcmd.PersistentFlags().StringVar(&rolearn, "aws-rolearn", os.Getenv("ROLE_ARN"), "AWS role ARN to assume")
+	rootcmd.PersistentFlags().StringVar(&awsprofile, "aws-profile", "", "AWS shared config profile, when --aws-key/--aws-secret are not set (default AWS_PROFILE)")
 	rootcmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", verbose, "verbose mode")
 	rootcmd.PersistentFlags().StringVarP(&dir, "dir", "d", dir, "root directory for scenario discovery (services/*/scenarios, cloudrun/*/scenarios, cronjobs/*/scenarios, serverless/*/scenarios, microapps/*/scenarios)")
 	rootcmd.PersistentFlags().StringVar(&repslack, "report-slack", repslack, "slack url for notification")
-	rootcmd.PersistentFlags().StringVar(&reppubsub, "report-pubsub", reppubsub, "pubsub topic for notification")
+	rootcmd.PersistentFlags().StringVar(&reppubsub, "report-pubsub", reppubsub, "pubsub topic (or SNS topic/NATS subject/Redis stream/Kafka topic, per the transport) for notification")
+	rootcmd.PersistentFlags().StringVar(&natsurl, "nats", os.Getenv("NATS_URL"), "NATS server URL, to use NATS JetStream instead of --pubsub or --snssqs")
+	rootcmd.PersistentFlags().StringVar(&natsstream, "nats-stream", "oops", "NATS subject (and work-queue stream) for commands, with --nats")
+	rootcmd.PersistentFlags().StringVar(&redisurl, "redis", os.Getenv("REDIS_URL"), "Redis URL (redis://[user:pass@]host:port/db), to use Redis Streams instead of --pubsub or --snssqs")
+	rootcmd.PersistentFlags().StringVar(&redisstream, "redis-stream", "oops", "Redis stream for commands, with --redis")
+	rootcmd.PersistentFlags().StringVar(&kafkabrokers, "kafka-brokers", os.Getenv("KAFKA_BROKERS"), "comma-separated Kafka brokers (host:port), to use Kafka instead of --pubsub or --snssqs")
+	rootcmd.PersistentFlags().StringVar(&kafkatopic, "kafka-topic", "oops", "Kafka topic for commands, with --kafka-brokers")
+	rootcmd.PersistentFlags().StringVar(&discoverylayout, "discovery-layout", "scenarios", "scenario discovery preset under --dir: scenarios (*/scenarios/*.yaml|yml), flat (all yaml|yml files)")
+	rootcmd.PersistentFlags().StringSliceVar(&discoveryinclude, "include", discoveryinclude, "globs (relative to --dir, ** for any depth) of scenario files to discover, overrides --discovery-layout")
+	rootcmd.PersistentFlags().StringSliceVar(&discoveryexclude, "exclude", discoveryexclude, "globs (relative to --dir, ** for any depth) of files/dirs to skip during discovery, in addition to .oopsignore")
+	rootcmd.PersistentFlags().BoolVar(&followsymlinks, "follow-symlinks", followsymlinks, "follow symlinked directories during discovery")
 	rootcmd.PersistentFlags().StringSliceVarP(&files, "scenarios", "s", files, "scenario file[s] to run, comma-separated, or multiple -s")
-	rootcmd.PersistentFlags().StringSliceVarP(&tags, "tags", "t", tags, "key=value labels in scenario files that are allowed to run, empty means all")
+	rootcmd.PersistentFlags().StringSliceVarP(&tags, "tags", "t", tags, "tag expressions for scenarios that are allowed to run (all must match), i.e. 'env in (dev,stg) && !slow', empty means all")
+	rootcmd.PersistentFlags().IntVar(&retries, "retries", retries, "max re-executions of a failing scenario, overridden by --tag-retries and the scenario's 'retries' field")
+	rootcmd.PersistentFlags().StringArrayVar(&tagretries, "tag-retries", tagretries, "retries for scenarios matching a tag expression, as '<tags>:<n>', i.e. 'team=billing && slow:2', first match wins")
+	rootcmd.PersistentFlags().StringVar(&quarantinefile, "quarantine-file", quarantinefile, "yaml file listing quarantined scenarios (path globs and/or tag expressions), whose failures don't fail the run")
 	rootcmd.PersistentFlags().StringVar(&githubtoken, "github-token", "", "GitHub token for commit status updates")
 	rootcmd.PersistentFlags().StringVar(&preprocesshook, "pre-process-hook", preprocesshook, "executable to run before processing each scenario, with the scenario file path as argument")
 	rootcmd.PersistentFlags().BoolVar(&skipNotif, "skip-result-notif", false, "skip result Slack notification")
 	rootcmd.AddCommand(runCmd())
+	rootcmd.AddCommand(listCmd())
+	rootcmd.AddCommand(triggerCmd())
+	rootcmd.AddCommand(tailCmd())
 }
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("[oops] ")
 	log.SetOutput(os.Stdout)
-	rootcmd.Execute()
+	if err := rootcmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
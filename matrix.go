@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/pkg/errors"
+)
+
+// ScenarioData represents the 'data' section of a scenario: either inline rows,
+// or a path to a CSV (with a header row) or JSON (array of objects) file.
+type ScenarioData struct {
+	File string
+	Rows []yaml.MapSlice
+}
+
+// UnmarshalYAML accepts either a file path or a list of key/value rows.
+func (d *ScenarioData) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var file string
+	if err := unmarshal(&file); err == nil {
+		d.File = file
+		return nil
+	}
+
+	return unmarshal(&d.Rows)
+}
+
+// scenarioParam is a single named parameter of a scenario variant.
+type scenarioParam struct {
+	Key   string
+	Value string
+}
+
+// scenarioVariant is a single execution of a scenario file after 'matrix' and
+// 'data' expansion. Scenarios without either have exactly one variant, named
+// after the file itself.
+type scenarioVariant struct {
+	Name   string // i.e. /path/file.yaml[region=us,plan=pro]
+	Params []scenarioParam
+}
+
+// rows returns the data rows, reading from file (relative to dir) if needed.
+func (d *ScenarioData) rows(dir string) ([][]scenarioParam, error) {
+	var out [][]scenarioParam
+	for _, r := range d.Rows {
+		var row []scenarioParam
+		for _, item := range r {
+			row = append(row, scenarioParam{fmt.Sprint(item.Key), fmt.Sprint(item.Value)})
+		}
+
+		out = append(out, row)
+	}
+
+	if d.File == "" {
+		return out, nil
+	}
+
+	file := d.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		recs, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+		if err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+
+		for i := 1; i < len(recs); i++ {
+			var row []scenarioParam
+			for j, k := range recs[0] {
+				if j < len(recs[i]) {
+					row = append(row, scenarioParam{strings.TrimSpace(k), recs[i][j]})
+				}
+			}
+
+			out = append(out, row)
+		}
+	case ".json":
+		var objs []map[string]interface{}
+		if err := json.Unmarshal(b, &objs); err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+
+		for _, o := range objs {
+			var keys []string
+			for k := range o {
+				keys = append(keys, k)
+			}
+
+			sort.Strings(keys)
+			var row []scenarioParam
+			for _, k := range keys {
+				row = append(row, scenarioParam{k, fmt.Sprint(o[k])})
+			}
+
+			out = append(out, row)
+		}
+	default:
+		return nil, fmt.Errorf("%v: unsupported data file, expecting .csv or .json", file)
+	}
+
+	return out, nil
+}
+
+// variants expands the 'matrix' (cartesian product, in declaration order) and
+// 'data' rows of scenario file into its individual executions.
+func (s *Scenario) variants(file string) ([]scenarioVariant, error) {
+	combos := [][]scenarioParam{nil}
+	for _, item := range s.Matrix {
+		key := fmt.Sprint(item.Key)
+		vals, ok := item.Value.([]interface{})
+		if !ok {
+			vals = []interface{}{item.Value}
+		}
+
+		var next [][]scenarioParam
+		for _, c := range combos {
+			for _, v := range vals {
+				nc := append(append([]scenarioParam{}, c...), scenarioParam{key, fmt.Sprint(v)})
+				next = append(next, nc)
+			}
+		}
+
+		combos = next
+	}
+
+	rows, err := s.Data.rows(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) > 0 {
+		var next [][]scenarioParam
+		for _, c := range combos {
+			for _, r := range rows {
+				next = append(next, append(append([]scenarioParam{}, c...), r...))
+			}
+		}
+
+		combos = next
+	}
+
+	var out []scenarioVariant
+	for _, c := range combos {
+		name := file
+		if len(c) > 0 {
+			var kv []string
+			for _, p := range c {
+				kv = append(kv, p.Key+"="+p.Value)
+			}
+
+			name = fmt.Sprintf("%v[%v]", file, strings.Join(kv, ","))
+		}
+
+		out = append(out, scenarioVariant{Name: name, Params: c})
+	}
+
+	return out, nil
+}
+
+// setParams exposes the variant's parameters to the scenario as env variables,
+// overriding the same keys in 'env'.
+func (s *Scenario) setParams(params []scenarioParam) {
+	if len(params) == 0 {
+		return
+	}
+
+	if s.Env == nil {
+		s.Env = make(map[string]string)
+	}
+
+	for _, p := range params {
+		s.Env[p.Key] = p.Value
+	}
+}
+
+// scenarioVariants reads scenario file and returns all of its variants.
+func scenarioVariants(file string) ([]scenarioVariant, error) {
+	yml, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Scenario
+	if err := yaml.Unmarshal(yml, &s); err != nil {
+		return nil, err
+	}
+
+	return s.variants(file)
+}
+
+// splitVariant splits a variant name (i.e. file.yaml[region=us]) into its file
+// path. The returned bool is true if name refers to a single variant.
+func splitVariant(name string) (string, bool) {
+	if !strings.HasSuffix(name, "]") {
+		return name, false
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		return name, false // actual file name with brackets
+	}
+
+	// The first '[' after a yaml file name; parameter values can have brackets.
+	for i := strings.Index(name, "["); i > 0; {
+		if f := name[:i]; strings.HasSuffix(f, ".yaml") || strings.HasSuffix(f, ".yml") {
+			return f, true
+		}
+
+		j := strings.Index(name[i+1:], "[")
+		if j < 0 {
+			break
+		}
+
+		i += j + 1
+	}
+
+	return name, false
+}
+
+// expandVariants replaces each scenario file in files with its variants, so each
+// variant can be distributed as its own 'process' message.
+func expandVariants(files []string) []string {
+	var out []string
+	for _, f := range files {
+		variants, err := scenarioVariants(f)
+		if err != nil {
+			log.Printf("expand %v failed, distributing as is: %v", f, err)
+			out = append(out, f)
+			continue
+		}
+
+		for _, v := range variants {
+			out = append(out, v.Name)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test__scenarioVariants(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "s.yaml")
+	os.WriteFile(filepath.Join(dir, "tenants.csv"), []byte("tenant,plan\nt1,pro\nt2,free\n"), 0644)
+	os.WriteFile(f, []byte("matrix:\n  region: [us, eu]\ndata: tenants.csv\n"), 0644)
+
+	variants, err := scenarioVariants(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		f + "[region=us,tenant=t1,plan=pro]",
+		f + "[region=us,tenant=t2,plan=free]",
+		f + "[region=eu,tenant=t1,plan=pro]",
+		f + "[region=eu,tenant=t2,plan=free]",
+	}
+
+	if len(variants) != len(want) {
+		t.Fatalf("got %v, want %v", variants, want)
+	}
+
+	for i, v := range variants {
+		if v.Name != want[i] {
+			t.Errorf("got %v, want %v", v.Name, want[i])
+		}
+	}
+
+	file, selected := splitVariant(want[1])
+	if file != f || !selected {
+		t.Fatalf("splitVariant: got %v, %v", file, selected)
+	}
+
+	if file, selected := splitVariant(f); file != f || selected {
+		t.Fatalf("splitVariant: got %v, %v", file, selected)
+	}
+
+	if file, selected := splitVariant(f + "[filter=a[0],region=us]"); file != f || !selected {
+		t.Fatalf("splitVariant: got %v, %v", file, selected)
+	}
+
+	os.WriteFile(f, []byte("data:\n- {tenant: t3}\n- {tenant: t4}\n"), 0644)
+	if got := expandVariants([]string{f}); len(got) != 2 || got[1] != f+"[tenant=t4]" {
+		t.Fatalf("expandVariants: got %v", got)
+	}
+
+	os.WriteFile(f, []byte("run: []\n"), 0644)
+	if got := expandVariants([]string{f}); len(got) != 1 || got[0] != f {
+		t.Fatalf("expandVariants: got %v", got)
+	}
+}
+
+// Test__doScenarioBadData checks that a scenario whose variants can't be loaded
+// is still reported, so that its run completes.
+func Test__doScenarioBadData(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "s.yaml")
+	os.WriteFile(f, []byte("data: missing.csv\n"), 0644)
+	tr := newMemTransport()
+	var done []string
+	doScenario(context.Background(), &doScenarioInput{
+		app:            &appctx{transport: tr},
+		ScenarioFiles:  []string{f, f + "[tenant=t1]"},
+		ReportPubsub:   "reports",
+		RunID:          "run1",
+		OnScenarioDone: func(scenario, status string) { done = append(done, scenario+":"+status) },
+	})
+
+	reports := tr.Reports()
+	if len(reports) != 2 || reports[0].Status != "error" || reports[1].Scenario != f+"[tenant=t1]" {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+
+	if len(done) != 2 || done[0] != f+":error" {
+		t.Fatalf("unexpected results %v", done)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+)
+
+const (
+	// How long a command can run before being redelivered, unless its handler is
+	// still running, in which case it is extended, see natsTransport.handle.
+	natsAckWait = time.Second * 60
+
+	// How long the report/progress streams keep messages.
+	natsTopicMaxAge = time.Hour * 24
+
+	// How many times a message is delivered to a durable consumer before it's
+	// dead-lettered, see natsTransport.handle.
+	natsMaxDeliver = 5
+)
+
+// natsTransport is a Transport over NATS JetStream. Commands go to a work-queue
+// stream (--nats-stream) with a single durable consumer shared by all replicas,
+// so each command is processed once, with ack/redelivery. Topics (reports and
+// progress, named as --report-pubsub and --scenario-pubsub) are subjects, each
+// with its own stream, consumed by durable consumers (per group) or ordered,
+// ephemeral ones (watchers). A message a durable consumer fails to handle
+// natsMaxDeliver times is published to the '<subject>-dead' subject (a stream
+// like the topics'), so it isn't redelivered forever.
+type natsTransport struct {
+	nc          *nats.Conn
+	js          jetstream.JetStream
+	subject     string // commands
+	reportTopic string // optional
+}
+
+// natsName returns name as a valid stream/consumer name.
+func natsName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '/', '\\':
+			return '_'
+		}
+
+		return r
+	}, name)
+}
+
+func newNatsTransport(url, subject, reportTopic string) (*natsTransport, error) {
+	nc, err := nats.Connect(url, nats.Name("oops"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "nats connect %v failed", url)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	t := &natsTransport{nc: nc, js: js, subject: subject, reportTopic: reportTopic}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      natsName(subject),
+		Subjects:  []string{subject},
+		Retention: jetstream.WorkQueuePolicy,
+	})
+
+	if err != nil {
+		nc.Close()
+		return nil, errors.Wrapf(err, "stream %v", subject)
+	}
+
+	if reportTopic != "" {
+		if err := t.ensureTopic(ctx, reportTopic); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// ensureTopic creates the stream for topic, if needed.
+func (t *natsTransport) ensureTopic(ctx context.Context, topic string) error {
+	_, err := t.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     natsName(topic),
+		Subjects: []string{topic},
+		MaxAge:   natsTopicMaxAge,
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, "stream %v", topic)
+	}
+
+	return nil
+}
+
+func (t *natsTransport) Name() string { return fmt.Sprintf("nats=%v", t.subject) }
+
+func (t *natsTransport) publish(subject string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err = t.js.Publish(ctx, subject, b)
+	return err
+}
+
+func (t *natsTransport) PublishCommand(c cmd) error { return t.publish(t.subject, c) }
+
+func (t *natsTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	if err := t.ensureTopic(ctx, t.subject+"-dead"); err != nil {
+		return err
+	}
+
+	cons, err := t.js.CreateOrUpdateConsumer(ctx, natsName(t.subject), jetstream.ConsumerConfig{
+		Durable:    natsName(t.subject) + "-workers",
+		AckPolicy:  jetstream.AckExplicitPolicy,
+		AckWait:    natsAckWait,
+		MaxDeliver: natsMaxDeliver,
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, "consumer for %v", t.subject)
+	}
+
+	return t.consume(ctx, cons, t.subject+"-dead", nil, handler)
+}
+
+func (t *natsTransport) PublishReport(r ReportPubsub) error {
+	if t.reportTopic == "" {
+		return nil
+	}
+
+	return t.publish(t.reportTopic, r)
+}
+
+type natsPublisher struct {
+	t     *natsTransport
+	topic string
+}
+
+func (p natsPublisher) Publish(key string, data interface{}) error { return p.t.publish(p.topic, data) }
+
+func (t *natsTransport) Publisher(topic string) (publisher, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := t.ensureTopic(ctx, topic); err != nil {
+		return nil, err
+	}
+
+	return natsPublisher{t: t, topic: topic}, nil
+}
+
+// SubscribeTopic uses the durable consumer named group, or an ordered consumer
+// of new messages for an empty group.
+func (t *natsTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	if err := t.ensureTopic(ctx, topic); err != nil {
+		return err
+	}
+
+	if group == "" {
+		cons, err := t.js.OrderedConsumer(ctx, natsName(topic), jetstream.OrderedConsumerConfig{
+			DeliverPolicy: jetstream.DeliverNewPolicy,
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, "consumer for %v", topic)
+		}
+
+		return t.consume(ctx, cons, "", ready, handler)
+	}
+
+	if err := t.ensureTopic(ctx, topic+"-dead"); err != nil {
+		return err
+	}
+
+	cons, err := t.js.CreateOrUpdateConsumer(ctx, natsName(topic), jetstream.ConsumerConfig{
+		Durable:       natsName(group),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       natsAckWait,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		MaxDeliver:    natsMaxDeliver,
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, "consumer %v for %v", group, topic)
+	}
+
+	return t.consume(ctx, cons, topic+"-dead", ready, handler)
+}
+
+// consume calls handler for each message of cons, one at a time, until ctx is
+// done, and ready (if not nil) once consuming. For a durable consumer, i.e. with a
+// dead-letter subject dead, messages are acked once handled, see handle; the
+// ordered consumers of watchers don't ack.
+func (t *natsTransport) consume(ctx context.Context, cons jetstream.Consumer, dead string, ready func(), handler func(data []byte) error) error {
+	it, err := cons.Messages(jetstream.PullMaxMessages(1))
+	if err != nil {
+		return err
+	}
+
+	signalReady(ready)
+	go func() {
+		<-ctx.Done()
+		it.Stop()
+	}()
+
+	for {
+		msg, err := it.Next()
+		switch {
+		case errors.Is(err, jetstream.ErrMsgIteratorClosed):
+			return nil
+		case err != nil:
+			log.Printf("nats: next failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if dead == "" {
+			handler(msg.Data())
+			continue
+		}
+
+		t.handle(msg, dead, handler)
+	}
+}
+
+// handle runs handler on msg, extending its ack deadline until done, then
+// acks it, or naks it for redelivery if handler failed. On its natsMaxDeliver-th
+// delivery (the last one, see MaxDeliver), a failed msg is published to dead,
+// with the error, and acked instead.
+func (t *natsTransport) handle(msg jetstream.Msg, dead string, handler func(data []byte) error) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(natsAckWait / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					log.Printf("nats: extend ack deadline failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	err := handler(msg.Data())
+	close(done)
+	if err != nil {
+		md, mdErr := msg.Metadata()
+		if mdErr != nil || md.NumDelivered < natsMaxDeliver {
+			if err := msg.Nak(); err != nil {
+				log.Printf("nats: nak failed: %v", err)
+			}
+
+			return
+		}
+
+		if err := t.deadLetter(msg, md, dead, err); err != nil {
+			log.Printf("nats: dead-letter to %v failed, message left unacked: %v", dead, err)
+			return
+		}
+
+		log.Printf("nats: %v/%v: moved to %v after %v deliveries: %v", msg.Subject(), md.Sequence.Stream, dead, md.NumDelivered, err)
+	}
+
+	if err := msg.Ack(); err != nil {
+		log.Printf("nats: ack failed: %v", err)
+	}
+}
+
+// deadLetter publishes msg, with the error of its last delivery, to dead.
+func (t *natsTransport) deadLetter(msg jetstream.Msg, md *jetstream.MsgMetadata, dead string, cause error) error {
+	m := nats.NewMsg(dead)
+	m.Data = msg.Data()
+	m.Header.Set("oops-source", fmt.Sprintf("%v/%v", msg.Subject(), md.Sequence.Stream))
+	m.Header.Set("oops-error", cause.Error())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err := t.js.PublishMsg(ctx, m)
+	return err
+}
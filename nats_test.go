@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func Test__natsName(t *testing.T) {
+	if got := natsName("oops.dev reports/*>"); got != "oops_dev_reports___" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// testNatsServer runs an embedded, JetStream-enabled server for the test.
+func testNatsServer(t *testing.T) string {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start()
+	if !s.ReadyForConnections(time.Second * 10) {
+		t.Fatal("nats-server not ready")
+	}
+
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+func Test__natsTransport(t *testing.T) {
+	tr, err := newNatsTransport(testNatsServer(t), "oops", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tr.nc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// Commands are kept in the work-queue stream until a replica subscribes, and
+	// a failed handler gets the command redelivered (nak).
+	if err := tr.PublishCommand(cmd{Code: "process", ID: "run1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := make(chan cmd, 2)
+	var attempts int
+	go tr.Subscribe(ctx, func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		attempts++
+		if attempts == 1 {
+			return fmt.Errorf("retry me")
+		}
+
+		cmds <- c
+		return nil
+	})
+
+	select {
+	case c := <-cmds:
+		if c.ID != "run1" || attempts != 2 {
+			t.Fatalf("unexpected command %+v after %v attempts", c, attempts)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for command")
+	}
+
+	// Reports: the durable group and the watcher both get the reports published
+	// once they're subscribed, and the watcher none of the older ones.
+	if err := tr.PublishReport(ReportPubsub{Scenario: "old.yaml", RunID: "run0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	grouped, watched := make(chan string, 2), make(chan string, 2)
+	ready := make(chan struct{}, 2)
+	subscribe := func(group string, ch chan string) {
+		go tr.SubscribeTopic(ctx, "reports", group, func() { ready <- struct{}{} }, func(data []byte) error {
+			var r ReportPubsub
+			json.Unmarshal(data, &r)
+			ch <- r.Scenario
+			return nil
+		})
+	}
+
+	subscribe("aggregator", grouped)
+	subscribe("", watched)
+	for range 2 {
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for subscriptions")
+		}
+	}
+
+	if err := tr.PublishReport(ReportPubsub{Scenario: "s.yaml", RunID: "run1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ch := range []chan string{grouped, watched} {
+		select {
+		case s := <-ch:
+			if s != "s.yaml" {
+				t.Fatalf("unexpected report %v", s)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for report")
+		}
+	}
+}
+
+// Test__natsDeadLetter checks that a command failing natsMaxDeliver times is
+// moved to the dead-letter subject, and acked, so it's not redelivered again.
+func Test__natsDeadLetter(t *testing.T) {
+	tr, err := newNatsTransport(testNatsServer(t), "oops", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tr.nc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	for _, s := range []string{"bad.yaml", "ok.yaml"} {
+		if err := tr.PublishCommand(cmd{Code: "process", ID: "run1", Scenario: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dead, ready := make(chan cmd, 1), make(chan struct{})
+	go tr.SubscribeTopic(ctx, "oops-dead", "", func() { close(ready) }, func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		dead <- c
+		return nil
+	})
+
+	<-ready
+	var mtx sync.Mutex
+	attempts := make(map[string]int)
+	go tr.Subscribe(ctx, func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		mtx.Lock()
+		defer mtx.Unlock()
+		attempts[c.Scenario]++
+		if c.Scenario == "bad.yaml" {
+			return fmt.Errorf("always fails")
+		}
+
+		return nil
+	})
+
+	select {
+	case c := <-dead:
+		if c.Scenario != "bad.yaml" {
+			t.Fatalf("unexpected dead letter %+v", c)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the dead letter")
+	}
+
+	for {
+		s, err := tr.js.Stream(ctx, natsName("oops"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := s.Info(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.State.Msgs == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%v commands left in the stream", info.State.Msgs)
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if attempts["bad.yaml"] != natsMaxDeliver || attempts["ok.yaml"] != 1 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+}
@@ -9,25 +9,27 @@ import (
 )
 
 type ScenarioProgressMessage struct {
-	Status           string   `json:"status"`
-	Scenario         string   `json:"scenario"`
-	RunID            string   `json:"run_id"`
-	Data             string   `json:"data"`
-	TotalScenarios   string   `json:"total_scenarios"`
-	Code             string   `json:"code"`
-	TriggerType      string   `json:"trigger_type,omitempty"`
-	RerunMode        string   `json:"rerun_mode,omitempty"`
-	OverallStatus    string   `json:"overall_status,omitempty"`
-	FailedCount      int64    `json:"failed_count,omitempty"`
-	FailedScenarios  []string `json:"failed_scenarios,omitempty"`
-	CommitSHA        string   `json:"commit_sha,omitempty"`
-	Repository       string   `json:"repository,omitempty"`
-	RunURL           string   `json:"run_url,omitempty"`
-	MissingTestsInPR bool     `json:"missing_tests_in_pr,omitempty"`
-	ShouldRunTests   bool     `json:"should_run_tests,omitempty"`
-	PRNumber         string   `json:"pr_number,omitempty"`
-	ApprovalCount    int      `json:"approval_count,omitempty"`
-	Reviewers        string   `json:"reviewers,omitempty"`
+	Status               string   `json:"status"`
+	Scenario             string   `json:"scenario"`
+	RunID                string   `json:"run_id"`
+	Data                 string   `json:"data"`
+	TotalScenarios       string   `json:"total_scenarios"`
+	Code                 string   `json:"code"`
+	TriggerType          string   `json:"trigger_type,omitempty"`
+	RerunMode            string   `json:"rerun_mode,omitempty"`
+	OverallStatus        string   `json:"overall_status,omitempty"`
+	FailedCount          int64    `json:"failed_count,omitempty"`
+	FailedScenarios      []string `json:"failed_scenarios,omitempty"`
+	FlakyScenarios       []string `json:"flaky_scenarios,omitempty"`       // i.e. "scenario (flaky 2/10)"
+	QuarantinedScenarios []string `json:"quarantined_scenarios,omitempty"` // failed, but not counted
+	CommitSHA            string   `json:"commit_sha,omitempty"`
+	Repository           string   `json:"repository,omitempty"`
+	RunURL               string   `json:"run_url,omitempty"`
+	MissingTestsInPR     bool     `json:"missing_tests_in_pr,omitempty"`
+	ShouldRunTests       bool     `json:"should_run_tests,omitempty"`
+	PRNumber             string   `json:"pr_number,omitempty"`
+	ApprovalCount        int      `json:"approval_count,omitempty"`
+	Reviewers            string   `json:"reviewers,omitempty"`
 }
 
 func notifyRunStarted(title, host, dist, trigger, webhook string, tags []string) {
@@ -165,6 +167,7 @@ func notifyRunComplete(msg ScenarioProgressMessage, webhook string) {
 		title = "Test Run Complete"
 		text = header + fmt.Sprintf("*Run Summary*\nTotal: %s\nPassed: %s\nFailed: 0", total, total)
 	}
+	text += runLabelsText(msg)
 	if msg.RunURL != "" {
 		text += fmt.Sprintf("\n\n<%s|View run>", msg.RunURL)
 	}
@@ -217,6 +220,7 @@ func notifyRerunComplete(msg ScenarioProgressMessage, webhook string) {
 	} else {
 		text = header + fmt.Sprintf("*Run Summary*\nTotal: %s\nPassed: %s\nFailed: 0", total, total)
 	}
+	text += runLabelsText(msg)
 
 	payload := SlackMessage{
 		Attachments: []SlackAttachment{{
@@ -267,3 +271,22 @@ func runSummaryText(total string, successCount, failedCount int64, failedScenari
 	}
 	return sb.String()
 }
+
+// runLabelsText returns the labelled scenarios of a completed run, i.e. the
+// flaky and quarantined ones, for both passed and failed runs.
+func runLabelsText(msg ScenarioProgressMessage) string {
+	var sb strings.Builder
+	if len(msg.FlakyScenarios) > 0 {
+		sb.WriteString("\n\n*Flaky scenarios:*")
+		for _, name := range msg.FlakyScenarios {
+			fmt.Fprintf(&sb, "\n• %v", name)
+		}
+	}
+	if len(msg.QuarantinedScenarios) > 0 {
+		sb.WriteString("\n\n*Quarantined failures (not counted):*")
+		for _, name := range msg.QuarantinedScenarios {
+			fmt.Fprintf(&sb, "\n• %v", name)
+		}
+	}
+	return sb.String()
+}
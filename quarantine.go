@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	yaml "github.com/goccy/go-yaml"
+)
+
+// How often the service reloads the quarantine list.
+const quarantineRefresh = time.Minute
+
+// Quarantine marks a scenario as known-broken (i.e. flaky): it still runs and
+// reports, but its failures are reported as 'quarantined' and don't fail the run.
+type Quarantine struct {
+	Reason string `yaml:"reason"`
+	Until  string `yaml:"until"` // 2006-01-02 (inclusive) or RFC3339, empty means no expiry
+	Issue  string `yaml:"issue"`
+}
+
+// active returns true if q has not expired at now. An invalid 'until' counts as
+// expired, so failures are never hidden by mistake.
+func (q *Quarantine) active(now time.Time) bool {
+	if q.Until == "" {
+		return true
+	}
+
+	if t, err := time.Parse(time.RFC3339, q.Until); err == nil {
+		return now.Before(t)
+	}
+
+	t, err := time.Parse("2006-01-02", q.Until)
+	if err != nil {
+		log.Printf("quarantine: invalid until %q: %v", q.Until, err)
+		return false
+	}
+
+	return now.Before(t.AddDate(0, 0, 1))
+}
+
+// attributes returns the report attributes for q.
+func (q *Quarantine) attributes() map[string]string {
+	attr := map[string]string{"quarantined": "true"}
+	for k, v := range map[string]string{
+		"quarantine_reason": q.Reason,
+		"quarantine_until":  q.Until,
+		"quarantine_issue":  q.Issue,
+	} {
+		if v != "" {
+			attr[k] = v
+		}
+	}
+
+	return attr
+}
+
+// quarantineEntry is an entry of --quarantine-file or --spanner-quarantine-table.
+// It applies to the scenarios matching both Scenario and Tags, if set.
+type quarantineEntry struct {
+	Scenario   string `yaml:"scenario"` // glob, relative to --dir ('**' for any depth)
+	Tags       string `yaml:"tags"`     // tag expression, see parseTags
+	Quarantine `yaml:",inline"`
+
+	tags tagMatcher // Tags, parsed when loaded, see quarantineList.get
+}
+
+// match returns true if e applies to scenario s from file.
+func (e *quarantineEntry) match(s *Scenario, file string) bool {
+	if e.Scenario == "" && e.Tags == "" {
+		return false
+	}
+
+	if e.Scenario != "" {
+		rel := file
+		if absDir, _ := filepath.Abs(dir); dir != "" && within(absDir, file) {
+			rel, _ = filepath.Rel(absDir, file)
+		}
+
+		if !matchAny([]string{e.Scenario}, filepath.ToSlash(rel), file) {
+			return false
+		}
+	}
+
+	if e.tags != nil {
+		return e.tags(s.Tags)
+	}
+
+	return true
+}
+
+// quarantineList is the entries of --quarantine-file and, in the service, of
+// --spanner-quarantine-table, reloaded every quarantineRefresh.
+type quarantineList struct {
+	mtx     sync.Mutex
+	client  *spanner.Client // nil if no table
+	entries []quarantineEntry
+	loaded  time.Time
+}
+
+// get returns the current entries, reloading them if stale. On failure, the
+// previous entries are kept. Entries with invalid tags are dropped (and logged)
+// when loaded.
+func (l *quarantineList) get() []quarantineEntry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !l.loaded.IsZero() && time.Since(l.loaded) < quarantineRefresh {
+		return l.entries
+	}
+
+	l.loaded = time.Now()
+	var entries []quarantineEntry
+	if quarantinefile != "" {
+		b, err := os.ReadFile(quarantinefile)
+		if err == nil {
+			err = yaml.Unmarshal(b, &entries)
+		}
+
+		if err != nil {
+			log.Printf("quarantine: %v: %v", quarantinefile, err)
+			return l.entries
+		}
+	}
+
+	if l.client != nil && spannerquarantinetable != "" {
+		rows, err := l.query()
+		if err != nil {
+			log.Printf("quarantine: %v: %v", spannerquarantinetable, err)
+			return l.entries
+		}
+
+		entries = append(entries, rows...)
+	}
+
+	l.entries = nil
+	for _, e := range entries {
+		if e.Tags != "" {
+			m, err := parseTags([]string{e.Tags})
+			if err != nil {
+				log.Printf("quarantine: dropping entry for %q: %v", e.Tags, err)
+				continue
+			}
+
+			e.tags = m
+		}
+
+		l.entries = append(l.entries, e)
+	}
+
+	return l.entries
+}
+
+// query reads the unexpired entries of --spanner-quarantine-table, expected to be:
+//
+//	CREATE TABLE <table> (
+//	  id STRING(MAX) NOT NULL,
+//	  scenario STRING(MAX),
+//	  tags STRING(MAX),
+//	  reason STRING(MAX),
+//	  until TIMESTAMP, -- NULL means no expiry
+//	  issue STRING(MAX),
+//	) PRIMARY KEY (id)
+func (l *quarantineList) query() ([]quarantineEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stmt := spanner.Statement{
+		SQL: fmt.Sprintf(`SELECT scenario, tags, reason, until, issue FROM %s
+WHERE until IS NULL OR until > CURRENT_TIMESTAMP()`, spannerquarantinetable),
+	}
+
+	var out []quarantineEntry
+	err := l.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var scenario, tags, reason, issue spanner.NullString
+		var until spanner.NullTime
+		if err := row.Columns(&scenario, &tags, &reason, &until, &issue); err != nil {
+			return err
+		}
+
+		e := quarantineEntry{
+			Scenario:   scenario.StringVal,
+			Tags:       tags.StringVal,
+			Quarantine: Quarantine{Reason: reason.StringVal, Issue: issue.StringVal},
+		}
+
+		if until.Valid {
+			e.Until = until.Time.UTC().Format(time.RFC3339)
+		}
+
+		out = append(out, e)
+		return nil
+	})
+
+	return out, err
+}
+
+// lookup returns the active quarantine of scenario s from file: its own
+// 'quarantine' field, else the first matching entry of l (which can be nil).
+// Returns nil if not quarantined, or if the quarantine has expired.
+func (l *quarantineList) lookup(s *Scenario, file string) *Quarantine {
+	now := time.Now()
+	if q := s.Quarantine; q != nil {
+		if q.active(now) {
+			return q
+		}
+
+		log.Printf("%v: quarantine expired (until %v), failures count", file, q.Until)
+	}
+
+	if l == nil {
+		return nil
+	}
+
+	entries := l.get()
+	for i := range entries {
+		e := &entries[i]
+		if !e.match(s, file) {
+			continue
+		}
+
+		if e.active(now) {
+			return &e.Quarantine
+		}
+
+		log.Printf("%v: quarantine expired (until %v), failures count", file, e.Until)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test__quarantineActive(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		until string
+		want  bool
+	}{
+		{"", true},
+		{"2026-10-18", true}, // inclusive
+		{"2026-10-17", false},
+		{"2026-10-18T11:00:00Z", false},
+		{"2026-10-18T13:00:00Z", true},
+		{"next week", false},
+	} {
+		q := Quarantine{Until: tc.until}
+		if got := q.active(now); got != tc.want {
+			t.Errorf("active(%q) = %v, want %v", tc.until, got, tc.want)
+		}
+	}
+}
+
+func Test__quarantineLookup(t *testing.T) {
+	defer func(d, f string) { dir, quarantinefile = d, f }(dir, quarantinefile)
+	dir = t.TempDir()
+	quarantinefile = filepath.Join(dir, "quarantine.yaml")
+	err := os.WriteFile(quarantinefile, []byte(`
+- scenario: services/billing/**
+  reason: flaky upstream
+  issue: https://github.com/org/repo/issues/1
+- tags: team=iam && slow
+  reason: slow env
+- scenario: services/old/**
+  until: 2020-01-01
+- tags: team=(
+  reason: invalid
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &quarantineList{}
+	billing := filepath.Join(dir, "services/billing/scenarios/01.yaml")
+	for _, tc := range []struct {
+		s      Scenario
+		file   string
+		reason string
+	}{
+		{Scenario{}, billing, "flaky upstream"},
+		{Scenario{Tags: map[string]string{"team": "iam", "slow": "1"}}, filepath.Join(dir, "services/iam/scenarios/01.yaml"), "slow env"},
+		{Scenario{Tags: map[string]string{"team": "iam"}}, filepath.Join(dir, "services/iam/scenarios/01.yaml"), ""},
+		{Scenario{}, filepath.Join(dir, "services/old/scenarios/01.yaml"), ""}, // expired
+		{Scenario{Quarantine: &Quarantine{Reason: "own"}}, billing, "own"},
+		{Scenario{Quarantine: &Quarantine{Reason: "own", Until: "2020-01-01"}}, billing, "flaky upstream"},
+	} {
+		var reason string
+		if q := l.lookup(&tc.s, tc.file); q != nil {
+			reason = q.Reason
+		}
+
+		if reason != tc.reason {
+			t.Errorf("lookup(%v) = %q, want %q", tc.file, reason, tc.reason)
+		}
+	}
+
+	// The entry with invalid tags is dropped when loaded.
+	if n := len(l.get()); n != 3 {
+		t.Errorf("expected 3 entries, got %v", n)
+	}
+
+	// Without a list, only the scenario's own field applies.
+	var nl *quarantineList
+	if q := nl.lookup(&Scenario{}, billing); q != nil {
+		t.Errorf("expected nil, got %v", q)
+	}
+}
+
+func Test__quarantinedNotFailed(t *testing.T) {
+	st := &runState{Results: map[string]scenarioResult{
+		"a": {Status: "success"},
+		"b": {Status: "error"},
+		"c": {Status: "quarantined"},
+	}}
+
+	if got := st.failed(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("failed() = %v", got)
+	}
+
+	if got := st.quarantined(); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("quarantined() = %v", got)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long a pending entry stays unacked before another consumer reclaims
+	// it (i.e. its pod crashed). Entries being handled are kept fresh, see
+	// redisTransport.handle.
+	redisClaimIdle = time.Minute * 2
+
+	// How long a read blocks, before checking for reclaimable entries again.
+	redisBlock = time.Second * 5
+
+	// Approximate max length of the report/progress streams.
+	redisTopicMaxLen = 10000
+
+	// How many times an entry is delivered to a group before it's dead-lettered,
+	// see redisTransport.handle.
+	redisMaxDeliver = 5
+)
+
+// redisTransport is a Transport over Redis Streams. Commands are XADDed to
+// --redis-stream and read by all replicas in a single consumer group, then XACKed
+// (and deleted) once handled; entries left pending by crashed pods are reclaimed
+// with XAUTOCLAIM. An entry a group fails to handle redisMaxDeliver times is moved
+// to the '<stream>-dead' stream, so it isn't reclaimed forever. Topics (reports and
+// progress, named as --report-pubsub and --scenario-pubsub) are separate, capped
+// streams, read by a consumer group per subscriber group, or with plain XREAD by
+// watchers.
+type redisTransport struct {
+	client      *redis.Client
+	stream      string // commands
+	reportTopic string // optional
+	consumer    string // our name in consumer groups
+	claimIdle   time.Duration
+	block       time.Duration
+}
+
+func newRedisTransport(url, stream, reportTopic string) (*redisTransport, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "redis url %v", url)
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, errors.Wrapf(err, "redis ping %v failed", url)
+	}
+
+	host, _ := os.Hostname()
+	return &redisTransport{
+		client:      client,
+		stream:      stream,
+		reportTopic: reportTopic,
+		consumer:    fmt.Sprintf("%v-%v", host, uniuri.NewLen(6)),
+		claimIdle:   redisClaimIdle,
+		block:       redisBlock,
+	}, nil
+}
+
+func (t *redisTransport) Name() string { return fmt.Sprintf("redis=%v", t.stream) }
+
+func (t *redisTransport) xadd(stream string, maxLen int64, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	return t.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: maxLen > 0,
+		Values: map[string]interface{}{"data": string(b)},
+	}).Err()
+}
+
+// Commands are not capped, as they are deleted once handled.
+func (t *redisTransport) PublishCommand(c cmd) error { return t.xadd(t.stream, 0, c) }
+
+// Subscribe creates the group from the start of the stream, so commands added
+// before the first replica starts are not lost.
+func (t *redisTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	return t.consume(ctx, t.stream, t.stream+"-workers", "0", true, nil, handler)
+}
+
+func (t *redisTransport) PublishReport(r ReportPubsub) error {
+	if t.reportTopic == "" {
+		return nil
+	}
+
+	return t.xadd(t.reportTopic, redisTopicMaxLen, r)
+}
+
+type redisPublisher struct {
+	t     *redisTransport
+	topic string
+}
+
+func (p redisPublisher) Publish(key string, data interface{}) error {
+	return p.t.xadd(p.topic, redisTopicMaxLen, data)
+}
+
+func (t *redisTransport) Publisher(topic string) (publisher, error) {
+	return redisPublisher{t: t, topic: topic}, nil
+}
+
+// SubscribeTopic reads topic in the consumer group named group (a new group
+// starts from the latest entry) or, for an empty group, with XREAD after the
+// latest entry at the time of the call.
+func (t *redisTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	if group != "" {
+		return t.consume(ctx, topic, group, "$", false, ready, handler)
+	}
+
+	// Not '$', which is only resolved when XREAD blocks.
+	last := "0-0"
+	latest, err := t.client.XRevRangeN(ctx, topic, "+", "-", 1).Result()
+	if err != nil {
+		return errors.Wrapf(err, "redis: last entry of %v", topic)
+	}
+
+	if len(latest) > 0 {
+		last = latest[0].ID
+	}
+
+	signalReady(ready)
+	for ctx.Err() == nil {
+		res, err := t.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{topic, last},
+			Block:   t.block,
+		}).Result()
+
+		if err != nil {
+			if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+				log.Printf("redis: xread %v failed: %v", topic, err)
+				time.Sleep(time.Second)
+			}
+
+			continue
+		}
+
+		for _, s := range res {
+			for _, m := range s.Messages {
+				last = m.ID
+				handler(redisData(m))
+			}
+		}
+	}
+
+	return nil
+}
+
+// redisData returns the payload of stream entry m.
+func redisData(m redis.XMessage) []byte {
+	v, _ := m.Values["data"].(string)
+	return []byte(v)
+}
+
+// consume calls handler for each entry of stream, one at a time, as a member of
+// consumer group (created at start, if new), until ctx is done, and ready (if not
+// nil) once the group exists. Entries idle for redisClaimIdle (i.e. from crashed
+// consumers) are reclaimed first. Handled entries are acked (and deleted,
+// with del); failed ones stay pending, to be reclaimed later.
+func (t *redisTransport) consume(ctx context.Context, stream, group, start string, del bool, ready func(), handler func(data []byte) error) error {
+	err := t.client.XGroupCreateMkStream(ctx, stream, group, start).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrapf(err, "redis: create group %v for %v", group, stream)
+	}
+
+	signalReady(ready)
+	for ctx.Err() == nil {
+		msgs, _, err := t.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: t.consumer,
+			MinIdle:  t.claimIdle,
+			Start:    "0-0",
+			Count:    1,
+		}).Result()
+
+		if err != nil && ctx.Err() == nil {
+			log.Printf("redis: xautoclaim %v failed: %v", stream, err)
+		}
+
+		if len(msgs) == 0 {
+			res, err := t.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    group,
+				Consumer: t.consumer,
+				Streams:  []string{stream, ">"},
+				Count:    1,
+				Block:    t.block,
+			}).Result()
+
+			if err != nil {
+				if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+					log.Printf("redis: xreadgroup %v failed: %v", stream, err)
+					time.Sleep(time.Second)
+				}
+
+				continue
+			}
+
+			for _, s := range res {
+				msgs = append(msgs, s.Messages...)
+			}
+		} else {
+			log.Printf("redis: reclaimed %v from %v", msgs[0].ID, stream)
+		}
+
+		for _, m := range msgs {
+			t.handle(stream, group, m, del, handler)
+		}
+	}
+
+	return nil
+}
+
+// handle runs handler on entry m, keeping it from being reclaimed while it
+// runs, then acks it if handler succeeded. A failed entry stays pending, unless it
+// was delivered redisMaxDeliver times (per XPENDING): then it's added to the
+// '<stream>-dead' stream, with the error, and acked.
+func (t *redisTransport) handle(stream, group string, m redis.XMessage, del bool, handler func(data []byte) error) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(t.claimIdle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Claiming it again resets its idle time.
+				err := t.client.XClaimJustID(context.Background(), &redis.XClaimArgs{
+					Stream:   stream,
+					Group:    group,
+					Consumer: t.consumer,
+					Messages: []string{m.ID},
+				}).Err()
+
+				if err != nil {
+					log.Printf("redis: refresh %v failed: %v", m.ID, err)
+				}
+			}
+		}
+	}()
+
+	err := handler(redisData(m))
+	close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err != nil {
+		n, derr := t.deliveries(ctx, stream, group, m.ID)
+		if derr != nil {
+			log.Printf("redis: %v: xpending failed: %v", m.ID, derr)
+		}
+
+		if derr != nil || n < redisMaxDeliver {
+			log.Printf("redis: %v: handler failed, will be reclaimed: %v", m.ID, err)
+			return
+		}
+
+		if derr := t.deadLetter(ctx, stream, m, err); derr != nil {
+			log.Printf("redis: %v: dead-letter failed, will be reclaimed: %v", m.ID, derr)
+			return
+		}
+
+		log.Printf("redis: %v: moved to %v-dead after %v deliveries: %v", m.ID, stream, n, err)
+	}
+
+	if err := t.client.XAck(ctx, stream, group, m.ID).Err(); err != nil {
+		log.Printf("redis: xack %v failed: %v", m.ID, err)
+		return
+	}
+
+	if del {
+		if err := t.client.XDel(ctx, stream, m.ID).Err(); err != nil {
+			log.Printf("redis: xdel %v failed: %v", m.ID, err)
+		}
+	}
+}
+
+// deadLetter adds entry m of stream, with the error of its last delivery, to the
+// '<stream>-dead' stream.
+func (t *redisTransport) deadLetter(ctx context.Context, stream string, m redis.XMessage, cause error) error {
+	return t.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream + "-dead",
+		MaxLen: redisTopicMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"data":   string(redisData(m)),
+			"source": stream + "/" + m.ID,
+			"error":  cause.Error(),
+		},
+	}).Err()
+}
+
+// deliveries returns how many times entry id was delivered to group.
+func (t *redisTransport) deliveries(ctx context.Context, stream, group, id string) (int64, error) {
+	pending, err := t.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(pending) == 0 {
+		return 0, errors.Errorf("redis: %v not pending in %v", id, group)
+	}
+
+	return pending[0].RetryCount, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testRedisTransport returns a transport on a miniredis server, with a short
+// claimIdle and block so failed entries are reclaimed quickly.
+func testRedisTransport(t *testing.T) *redisTransport {
+	mr := miniredis.RunT(t)
+	tr, err := newRedisTransport("redis://"+mr.Addr(), "oops", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { tr.client.Close() })
+	tr.claimIdle = time.Millisecond * 100
+	tr.block = time.Millisecond * 100
+	return tr
+}
+
+// Test__redisTransportReclaim checks that a failed command stays pending in the
+// group until it's reclaimed with XAUTOCLAIM, and that handled commands are
+// acked and deleted from the stream.
+func Test__redisTransportReclaim(t *testing.T) {
+	tr := testRedisTransport(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	if err := tr.PublishCommand(cmd{Code: "process", ID: "run1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, handled := make(chan struct{}), make(chan cmd, 1)
+	var attempts int
+	go tr.Subscribe(ctx, func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		attempts++
+		if attempts == 1 {
+			close(failed)
+			return fmt.Errorf("retry me")
+		}
+
+		handled <- c
+		return nil
+	})
+
+	<-failed
+	select {
+	case c := <-handled:
+		if c.ID != "run1" || attempts != 2 {
+			t.Fatalf("unexpected command %+v after %v attempts", c, attempts)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the reclaimed command")
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for tr.client.XLen(ctx, "oops").Val() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("command not deleted, len=%v", tr.client.XLen(ctx, "oops").Val())
+		}
+
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	if n := tr.client.XPending(ctx, "oops", "oops-workers").Val().Count; n != 0 {
+		t.Fatalf("expected no pending entries, got %v", n)
+	}
+}
+
+// Test__redisTransportTopics checks that report entries are kept in the stream
+// (not deleted, unlike commands), and that a watcher reads from the latest entry.
+func Test__redisTransportTopics(t *testing.T) {
+	tr := testRedisTransport(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := tr.PublishReport(ReportPubsub{Scenario: "old.yaml", RunID: "run0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan struct{})
+	watched := make(chan string, 2)
+	go tr.SubscribeTopic(ctx, "reports", "", func() { close(ready) }, func(data []byte) error {
+		var r ReportPubsub
+		json.Unmarshal(data, &r)
+		watched <- r.Scenario
+		return nil
+	})
+
+	<-ready
+	if err := tr.PublishReport(ReportPubsub{Scenario: "s.yaml", RunID: "run1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-watched:
+		if s != "s.yaml" {
+			t.Fatalf("unexpected report %v", s)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for report")
+	}
+
+	if n := tr.client.XLen(ctx, "reports").Val(); n != 2 {
+		t.Fatalf("expected 2 reports kept, got %v", n)
+	}
+}
+
+// Test__redisTransportEarlyCommands checks that commands added before any
+// replica subscribed (i.e. before the group exists) are not lost.
+func Test__redisTransportEarlyCommands(t *testing.T) {
+	tr := testRedisTransport(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	for _, id := range []string{"run1", "run2"} {
+		if err := tr.PublishCommand(cmd{Code: "start", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmds := make(chan string, 2)
+	go tr.Subscribe(ctx, func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		cmds <- c.ID
+		return nil
+	})
+
+	for _, want := range []string{"run1", "run2"} {
+		select {
+		case id := <-cmds:
+			if id != want {
+				t.Fatalf("expected %v, got %v", want, id)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for command")
+		}
+	}
+}
+
+// Test__redisTransportDeadLetter checks that a command failing redisMaxDeliver
+// times is moved to the dead-letter stream, and acked.
+func Test__redisTransportDeadLetter(t *testing.T) {
+	tr := testRedisTransport(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	for _, s := range []string{"bad.yaml", "ok.yaml"} {
+		if err := tr.PublishCommand(cmd{Code: "process", ID: "run1", Scenario: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mtx sync.Mutex
+	attempts := make(map[string]int)
+	go tr.Subscribe(ctx, func(data []byte) error {
+		var c cmd
+		json.Unmarshal(data, &c)
+		mtx.Lock()
+		defer mtx.Unlock()
+		attempts[c.Scenario]++
+		if c.Scenario == "bad.yaml" {
+			return fmt.Errorf("always fails")
+		}
+
+		return nil
+	})
+
+	for tr.client.XLen(ctx, "oops-dead").Val() == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the dead letter")
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	dead := tr.client.XRange(ctx, "oops-dead", "-", "+").Val()
+	var c cmd
+	json.Unmarshal(redisData(dead[0]), &c)
+	if len(dead) != 1 || c.Scenario != "bad.yaml" || dead[0].Values["error"] != "always fails" {
+		t.Fatalf("unexpected dead letters %+v", dead)
+	}
+
+	if n := tr.client.XPending(ctx, "oops", "oops-workers").Val().Count; n != 0 {
+		t.Fatalf("expected no pending entries, got %v", n)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if attempts["bad.yaml"] != redisMaxDeliver || attempts["ok.yaml"] != 1 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// rerunModes maps the rerun command codes to their 'rerun_mode' metadata.
+var rerunModes = map[string]string{
+	"rerun_failed":    "failed",
+	"rerun_scenarios": "specific",
+}
+
+// rerunSelect returns the scenarios of st to rerun: the ones that did not
+// succeed for mode 'failed', or the requested ones for mode 'specific'. The
+// requested scenarios can be relative to --dir, and don't need to be in st.
+func rerunSelect(st *runState, mode string, requested []string) []string {
+	var out []string
+	switch mode {
+	case "failed":
+		out = st.failed()
+	case "specific":
+		seen := make(map[string]bool)
+		for _, f := range requested {
+			if !filepath.IsAbs(f) {
+				if _, ok := st.Results[f]; !ok && dir != "" {
+					f, _ = filepath.Abs(filepath.Join(dir, f))
+				}
+			}
+
+			if !seen[f] {
+				seen[f] = true
+				out = append(out, f)
+			}
+		}
+
+		sort.Strings(out)
+	}
+
+	return out
+}
+
+// rerunMetadata returns the metadata of the prior run (as reported by its
+// workers), overridden by the rerun command's own metadata.
+func rerunMetadata(st *runState, override map[string]interface{}) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	if b := st.Attributes["metadata"]; b != "" {
+		if err := json.Unmarshal([]byte(b), &metadata); err != nil {
+			log.Printf("rerun: invalid metadata for %v: %v", st.RunID, err)
+		}
+	}
+
+	for k, v := range override {
+		metadata[k] = v
+	}
+
+	return metadata
+}
+
+// rerun handles the 'rerun_failed' and 'rerun_scenarios' commands: it looks up
+// the prior run (RerunOf, or else the latest results of GroupID) in the result
+// store, then distributes the scenarios to rerun under a new run ID in the same
+// group. Returns false if nothing was distributed.
+func rerun(app *appctx, c cmd) bool {
+	mode := rerunModes[c.Code]
+	if app.results == nil {
+		log.Printf("rerun: no result store")
+		return false
+	}
+
+	if c.RerunOf == "" && c.GroupID == "" {
+		log.Printf("rerun: one of rerun_of or group_id is required")
+		return false
+	}
+
+	st, err := app.results.Results(context.Background(), c.RerunOf, c.GroupID)
+	if err != nil {
+		log.Printf("rerun: lookup rerun_of=%v group_id=%v failed: %v", c.RerunOf, c.GroupID, err)
+		return false
+	}
+
+	if len(st.Results) == 0 && mode == "failed" {
+		log.Printf("rerun: no results for rerun_of=%v group_id=%v (is --aggregate on, with a shared --result-store?)", c.RerunOf, c.GroupID)
+		return false
+	}
+
+	files := rerunSelect(st, mode, c.Scenarios)
+	if len(files) == 0 {
+		log.Printf("rerun: nothing to rerun for %v (mode=%v)", st.RunID, mode)
+		return false
+	}
+
+	id := c.ID
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	groupID := c.GroupID
+	if groupID == "" {
+		groupID = st.GroupID
+	}
+
+	if groupID == "" {
+		groupID = st.RunID
+	}
+
+	metadata := rerunMetadata(st, c.Metadata)
+	metadata["trigger_type"] = "rerun"
+	metadata["rerun_mode"] = mode
+	metadata["rerun_of"] = st.RunID
+	metadata["rerun_total"] = fmt.Sprintf("%d", len(files))
+	log.Printf("rerun: run_id=%v group_id=%v rerun_of=%v mode=%v scenarios=%d", id, groupID, st.RunID, mode, len(files))
+	publishProcess(app, files, id, groupID, metadata)
+
+	if repslack != "" {
+		repository, _ := metadata["repository"].(string)
+		notifyRerunStarted(id, mode, fmt.Sprintf("%d", len(files)), repository, repslack)
+	}
+
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test__rerunSelect(t *testing.T) {
+	store := newMemResultStore()
+	record := func(runID, scenario, status string) {
+		store.Record(context.Background(), ReportPubsub{
+			Scenario: scenario,
+			Status:   status,
+			RunID:    runID,
+			GroupID:  "g1",
+			Attributes: map[string]string{
+				"total_scenarios": "3",
+				"metadata":        `{"repository":"org/repo","run_url":"old"}`,
+			},
+		})
+
+		time.Sleep(time.Millisecond) // distinct report times
+	}
+
+	record("run1", "/d/a.yaml", "success")
+	record("run1", "/d/b.yaml", "error")
+	record("run1", "/d/c.yaml[region=us]", "error")
+	record("run2", "/d/b.yaml", "success") // rerun of run1's failures, b passed
+	record("run2", "/d/c.yaml[region=us]", "error")
+
+	st, _ := store.Results(context.Background(), "run1", "")
+	if got := rerunSelect(st, "failed", nil); !reflect.DeepEqual(got, []string{"/d/b.yaml", "/d/c.yaml[region=us]"}) {
+		t.Fatalf("unexpected run1 failures: %v", got)
+	}
+
+	st, _ = store.Results(context.Background(), "", "g1")
+	if st.RunID != "run2" {
+		t.Fatalf("expected latest run run2, got %v", st.RunID)
+	}
+
+	if got := rerunSelect(st, "failed", nil); !reflect.DeepEqual(got, []string{"/d/c.yaml[region=us]"}) {
+		t.Fatalf("unexpected group failures: %v", got)
+	}
+
+	defer func(d string) { dir = d }(dir)
+	dir = "/d"
+	if got := rerunSelect(st, "specific", []string{"a.yaml", "/d/a.yaml", "/x/y.yaml"}); !reflect.DeepEqual(got, []string{"/d/a.yaml", "/x/y.yaml"}) {
+		t.Fatalf("unexpected specific scenarios: %v", got)
+	}
+
+	metadata := rerunMetadata(st, map[string]interface{}{"run_url": "new"})
+	if metadata["repository"] != "org/repo" || metadata["run_url"] != "new" {
+		t.Fatalf("unexpected metadata: %v", metadata)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// retryRule is a --tag-retries entry: scenarios matching the tag expression are
+// retried up to n times.
+type retryRule struct {
+	match tagMatcher
+	n     int
+}
+
+// parseTagRetries parses --tag-retries entries, formatted as "<tag expression>:<n>",
+// i.e. "team=billing && !slow:2".
+func parseTagRetries(entries []string) ([]retryRule, error) {
+	var rules []retryRule
+	for _, e := range entries {
+		i := strings.LastIndex(e, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("tag-retries %q: expecting <tags>:<n>", e)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(e[i+1:]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("tag-retries %q: invalid count", e)
+		}
+
+		m, err := parseTags([]string{e[:i]})
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, retryRule{match: m, n: n})
+	}
+
+	return rules, nil
+}
+
+// retries returns how many times s is re-executed after a failure: the scenario's
+// own 'retries' field, else the first matching --tag-retries rule, else --retries.
+func (s *Scenario) retries() int {
+	if s.Retries != nil {
+		return *s.Retries
+	}
+
+	for _, r := range retryRules {
+		if r.match(s.Tags) {
+			return r.n
+		}
+	}
+
+	return retries
+}
+
+// executeWithRetries runs execute on scenario file f, then re-executes it while it
+// fails, up to s.retries() more times. The cleanups run between attempts, so each
+// one starts afresh. Returns true if the run was cancelled midway.
+func (s *Scenario) executeWithRetries(f string) bool {
+	max := s.retries()
+	for {
+		s.attempts++
+		if s.execute(f) {
+			return true
+		}
+
+		if len(s.errs) == 0 || s.attempts > max {
+			return false
+		}
+
+		log.Printf("%v: attempt %d/%d failed, retrying: %v", f, s.attempts, max+1, s.errs)
+		if errs := s.runCleanup(f); len(errs) > 0 {
+			log.Printf("%v: cleanup before retry: %v", f, errs)
+		}
+
+		if s.interrupted(len(s.Run), f) {
+			return true
+		}
+
+		s.errs, s.steps = nil, nil
+	}
+}
+
+// flakeStat is the retry history of a scenario, see resultStore.FlakeRates.
+type flakeStat struct {
+	Runs  int // recorded results
+	Flaky int // of which passed on retry
+}
+
+// flakyLabels returns the scenarios of st that passed on retry in this run, or
+// that did in past runs as per stats, as sorted "scenario (flaky x/y)" labels.
+func flakyLabels(st *runState, stats map[string]flakeStat) []string {
+	var out []string
+	var scenarios []string
+	for f := range st.Results {
+		scenarios = append(scenarios, f)
+	}
+
+	sort.Strings(scenarios)
+	for _, f := range scenarios {
+		stat := stats[f]
+		if !st.Results[f].PassedOnRetry && stat.Flaky == 0 {
+			continue
+		}
+
+		if stat.Runs == 0 { // no history, count this run only
+			stat = flakeStat{Runs: 1, Flaky: 1}
+		}
+
+		out = append(out, fmt.Sprintf("%v (flaky %d/%d)", f, stat.Flaky, stat.Runs))
+	}
+
+	return out
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+func Test__retries(t *testing.T) {
+	defer func(n int, r []retryRule) { retries, retryRules = n, r }(retries, retryRules)
+	retries = 1
+	var err error
+	retryRules, err = parseTagRetries([]string{"team=billing && slow:3", "team=billing:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseTagRetries([]string{"team=billing"}); err == nil {
+		t.Fatal("expected error for missing count")
+	}
+
+	zero := 0
+	for _, tc := range []struct {
+		s    Scenario
+		want int
+	}{
+		{Scenario{Tags: map[string]string{"team": "billing", "slow": "true"}}, 3},
+		{Scenario{Tags: map[string]string{"team": "billing"}}, 2},
+		{Scenario{Tags: map[string]string{"team": "iam"}}, 1},
+		{Scenario{Tags: map[string]string{"team": "billing"}, Retries: &zero}, 0},
+	} {
+		if got := tc.s.retries(); got != tc.want {
+			t.Errorf("retries(%v) = %v, want %v", tc.s.Tags, got, tc.want)
+		}
+	}
+}
+
+func Test__executeWithRetries(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer ts.Close()
+	for _, tc := range []struct {
+		retries  string
+		attempts int
+		ok       bool
+	}{
+		{"1", 2, false},
+		{"2", 3, true},
+	} {
+		calls = 0
+		var s Scenario
+		err := yaml.Unmarshal([]byte(`
+retries: `+tc.retries+`
+run:
+- http: {method: GET, url: `+ts.URL+`, asserts: {status_code: 200}}
+`), &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.me = &s
+		s.input = &doScenarioInput{}
+		if err := s.resolveIncludes(t.TempDir()+"/s.yaml", "", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if s.executeWithRetries(t.TempDir() + "/s.yaml") {
+			t.Fatal("unexpected cancel")
+		}
+
+		if s.attempts != tc.attempts || (len(s.errs) == 0) != tc.ok {
+			t.Errorf("retries=%v: attempts=%v errs=%v", tc.retries, s.attempts, s.errs)
+		}
+
+		if len(s.steps) != 1 {
+			t.Errorf("retries=%v: expected steps of the last attempt only, got %v", tc.retries, s.steps)
+		}
+	}
+}
+
+func Test__flakeRates(t *testing.T) {
+	ctx := context.Background()
+	store := newMemResultStore()
+	for _, r := range []ReportPubsub{
+		{RunID: "r1", Scenario: "a", Status: "success", Attributes: map[string]string{"attempts": "2", "passed_on_retry": "true"}},
+		{RunID: "r1", Scenario: "b", Status: "success", Attributes: map[string]string{"attempts": "1"}},
+		{RunID: "r2", Scenario: "a", Status: "success", Attributes: map[string]string{"attempts": "1"}},
+		{RunID: "r2", Scenario: "b", Status: "error", Attributes: map[string]string{"attempts": "3"}},
+	} {
+		if _, err := store.Record(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, _ := store.FlakeRates(ctx, []string{"a", "b", "c"})
+	want := map[string]flakeStat{"a": {Runs: 2, Flaky: 1}, "b": {Runs: 2}}
+	if !reflect.DeepEqual(stats, want) {
+		t.Fatalf("got %v, want %v", stats, want)
+	}
+
+	// 'a' passed first time in r2, but is still labelled from its history.
+	st, _ := store.Results(ctx, "r2", "")
+	labels := flakyLabels(st, stats)
+	if !reflect.DeepEqual(labels, []string{"a (flaky 1/2)"}) {
+		t.Fatalf("got %v", labels)
+	}
+
+	st, _ = store.Results(ctx, "r1", "")
+	if labels := flakyLabels(st, nil); !reflect.DeepEqual(labels, []string{"a (flaky 1/1)"}) {
+		t.Fatalf("got %v", labels)
+	}
+}
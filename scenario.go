@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -15,6 +16,7 @@ import (
 	yaml "github.com/goccy/go-yaml"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 // Asserts represents acceptance criteria for a test case
@@ -22,6 +24,10 @@ type Asserts struct {
 	Code         int    `yaml:"status_code"`
 	ValidateJSON string `yaml:"validate_json"`
 	Script       string `yaml:"script"`
+	ContentType  string `yaml:"content_type"`
+	Size         int64  `yaml:"size"`
+	SHA256       string `yaml:"sha256"`
+	MD5          string `yaml:"md5"`
 }
 
 // RunHTTP represents configuration on how to run HTTP test
@@ -34,12 +40,19 @@ type RunHTTP struct {
 	Forms       map[string]string `yaml:"forms"`
 	Payload     string            `yaml:"payload"`
 	ResponseOut string            `yaml:"response_out"`
+	Stream      bool              `yaml:"stream"` // write body to response_out without buffering
 	Asserts     *Asserts          `yaml:"asserts"`
 }
 
 // Run represent methods for testing
 type Run struct {
-	HTTP RunHTTP `yaml:"http"`
+	When            string            `yaml:"when"`
+	ContinueOnError bool              `yaml:"continue_on_error"`
+	Uses            string            `yaml:"uses"`
+	With            map[string]string `yaml:"with"`
+	HTTP            RunHTTP           `yaml:"http"`
+	WebSocket       *RunWebSocket     `yaml:"websocket"`
+	SSE             *RunSSE           `yaml:"sse"`
 }
 
 // ReportPubsub represents configuration to report to pubsub
@@ -57,14 +70,36 @@ type ReportPubsub struct {
 type Scenario struct {
 	Maintainers []string          `yaml:"maintainers"`
 	Tags        map[string]string `yaml:"tags"`
+	Include     []Include         `yaml:"include"`
 	Env         map[string]string `yaml:"env"`
 	Prepare     string            `yaml:"prepare"`
 	Run         []Run             `yaml:"run"`
 	Check       string            `yaml:"check"`
+	Cleanup     Cleanup           `yaml:"cleanup"`
+	FailFast    bool              `yaml:"fail_fast"`
+	Retries     *int              `yaml:"retries"` // overrides --tag-retries and --retries
+	Quarantine  *Quarantine       `yaml:"quarantine"`
+	Matrix      yaml.MapSlice     `yaml:"matrix"`
+	Data        ScenarioData      `yaml:"data"`
+
+	me       *Scenario
+	input    *doScenarioInput
+	ctx      context.Context // done when the run is cancelled, see runCtx
+	errs     []error
+	steps    []stepResult
+	prepares []namedScript // including from fragments, see resolveIncludes
+	checks   []namedScript
+	cleanups []Cleanup
+	attempts int // executions so far, see executeWithRetries
+}
+
+// runCtx returns the context of the scenario's HTTP requests and scripts.
+func (s *Scenario) runCtx() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
 
-	me    *Scenario
-	input *doScenarioInput
-	errs  []error
+	return s.ctx
 }
 
 func (s Scenario) getHead(file string) ([]byte, error) {
@@ -90,10 +125,10 @@ func (s *Scenario) RunScript(file string) ([]byte, error) {
 	var c *exec.Cmd
 	switch {
 	case strings.Contains(runner, "python"):
-		c = exec.Command(runner, file)
+		c = exec.CommandContext(s.runCtx(), runner, file)
 	default:
 		// Assume it's a shell interpreter.
-		c = exec.Command(runner, "-c", file)
+		c = exec.CommandContext(s.runCtx(), runner, "-c", file)
 	}
 
 	c.Env = os.Environ()
@@ -168,6 +203,7 @@ func (s Scenario) Errorf(message string, args ...any) {
 
 type doScenarioInput struct {
 	app            *appctx
+	quarantine     *quarantineList
 	ScenarioFiles  []string
 	WorkDir        string
 	ReportSlack    string
@@ -179,12 +215,28 @@ type doScenarioInput struct {
 	OnScenarioDone func(scenario, status string)
 }
 
-func publishCancelledReport(in *doScenarioInput, scenarioFile string, startedAt time.Time) {
-	if in.app == nil || in.app.rpub == nil || in.ReportPubsub == "" {
+func publishCancelledReport(in *doScenarioInput, scenarioFile string, startedAt time.Time, extra map[string]string) {
+	publishStatusReport(in, scenarioFile, startedAt, "cancelled", "", extra)
+}
+
+// publishInterruptedReport reports scenarioFile as 'interrupted': stopped by the
+// service's shutdown (see --shutdown-grace), as opposed to a cancelled run.
+func publishInterruptedReport(in *doScenarioInput, scenarioFile string, startedAt time.Time, extra map[string]string) {
+	publishStatusReport(in, scenarioFile, startedAt, "interrupted", "service shutting down", extra)
+}
+
+// publishStatusReport reports scenarioFile with status and data, for scenarios
+// that didn't run to completion.
+func publishStatusReport(in *doScenarioInput, scenarioFile string, startedAt time.Time, status, data string, extra map[string]string) {
+	if in.app == nil || in.app.transport == nil || in.ReportPubsub == "" {
 		return
 	}
 
 	attr := make(map[string]string)
+	for k, v := range extra {
+		attr[k] = v
+	}
+
 	attr["started_at"] = startedAt.Format("2006-01-02 15:04:05")
 	if pubsub != "" {
 		attr["pubsub"] = pubsub
@@ -213,303 +265,601 @@ func publishCancelledReport(in *doScenarioInput, scenarioFile string, startedAt
 
 	r := ReportPubsub{
 		Scenario:   scenarioFile,
-		Status:     "cancelled",
-		Data:       "",
+		Status:     status,
+		Data:       data,
 		MessageID:  uuid.NewString(),
 		RunID:      in.RunID,
 		Attributes: attr,
 		GroupID:    in.GroupID,
 	}
 
-	if err := in.app.rpub.Publish(r.MessageID, r); err != nil {
-		log.Printf("publishCancelledReport: publish failed for %s: %v", scenarioFile, err)
+	if err := in.app.transport.PublishReport(r); err != nil {
+		log.Printf("publishStatusReport: publish failed for %s: %v", scenarioFile, err)
 	} else {
-		log.Printf("publishCancelledReport: reported cancelled for run_id=%s scenario=%s", in.RunID, scenarioFile)
+		log.Printf("publishStatusReport: reported %s for run_id=%s scenario=%s", status, in.RunID, scenarioFile)
 	}
 }
 
-func isAllowed(s *Scenario) bool {
-	if len(tags) == 0 {
-		return true
+// runHTTP executes the http step at index i and returns the response status code,
+// if any. Failures are appended to s.errs.
+func (s *Scenario) runHTTP(i int, prefix string, h *RunHTTP) int {
+	// Parse url.
+	fn := fmt.Sprintf("%v_url", prefix)
+	nv, err := s.ParseValue(h.URL, fn)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, h.URL))
+		return 0
+	}
+
+	u, err := url.Parse(nv)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "url.Parse[%v]", i))
+		return 0
 	}
 
-	var matched int
-	for _, t := range tags {
-		tt := strings.Split(t, "=")
-		if len(tt) != 2 {
+	e := httpexpect.New(s, u.Scheme+"://"+u.Host)
+	req := e.Request(h.Method, u.Path).WithContext(s.runCtx())
+	for k, v := range h.Headers {
+		fn := fmt.Sprintf("%v_hdr.%v", prefix, k)
+		nv, err := s.ParseValue(v, fn)
+		if err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, v))
 			continue
 		}
 
-		for k, v := range s.Tags {
-			if k == tt[0] && v == tt[1] {
-				matched++
+		req = req.WithHeader(k, nv)
+		log.Printf("[header] %v: %v", k, nv)
+	}
+
+	for k, v := range h.QueryParams {
+		fn := fmt.Sprintf("%v_qparams.%v", prefix, k)
+		nv, _ := s.ParseValue(v, fn)
+		req = req.WithQuery(k, nv)
+	}
+
+	if len(h.Files) > 0 {
+		req = req.WithMultipart()
+	}
+	for k, v := range h.Files {
+		fn := fmt.Sprintf("%v_files.%v", prefix, k)
+		nv, _ := s.ParseValue(v, fn)
+		req = req.WithFile(k, nv)
+	}
+
+	for k, v := range h.Forms {
+		fn := fmt.Sprintf("%v_forms.%v", prefix, k)
+		nv, _ := s.ParseValue(v, fn)
+		req = req.WithFormField(k, nv)
+	}
+
+	if h.Payload != "" {
+		fn := fmt.Sprintf("%v_payload", prefix)
+		nv, _ := s.ParseValue(h.Payload, fn)
+		req = req.WithBytes([]byte(nv))
+	}
+
+	resp := req.Expect()
+	var code int
+	if r := resp.Raw(); r != nil {
+		code = r.StatusCode
+	}
+
+	var digest *bodyDigest
+	switch {
+	case h.Stream:
+		digest, err = streamBody(resp.Reader(), h.ResponseOut)
+		if err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err, "stream[%v]: %v", i, h.ResponseOut))
+			return code
+		}
+
+		log.Printf("[response] streamed %d bytes to %q, sha256=%v, md5=%v",
+			digest.Size, h.ResponseOut, digest.SHA256, digest.MD5)
+	case h.ResponseOut != "":
+		body := resp.Body().Raw()
+		s.Write(h.ResponseOut, []byte(body))
+		log.Printf("[response] %v", body)
+	}
+
+	if h.Asserts == nil {
+		return code
+	}
+
+	resp = resp.Status(h.Asserts.Code)
+
+	if h.Asserts.ContentType != "" {
+		resp.HasContentType(h.Asserts.ContentType)
+	}
+
+	if h.Asserts.ValidateJSON != "" {
+		switch {
+		case !h.Stream:
+			resp.JSON().Schema(h.Asserts.ValidateJSON)
+		case h.ResponseOut == "":
+			s.errs = append(s.errs, fmt.Errorf("validate_json[%v]: streaming requires response_out", i))
+		default:
+			// The body is no longer in memory; validate the file instead.
+			abs, _ := filepath.Abs(h.ResponseOut)
+			doc := gojsonschema.NewReferenceLoader("file://" + abs)
+			if err := validateJSON(h.Asserts.ValidateJSON, doc); err != nil {
+				s.errs = append(s.errs, errors.Wrapf(err, "validate_json[%v]", i))
 			}
 		}
 	}
 
-	return matched == len(tags)
+	if h.Asserts.Size > 0 || h.Asserts.SHA256 != "" || h.Asserts.MD5 != "" {
+		if digest == nil {
+			digest = digestBytes([]byte(resp.Body().Raw()))
+		}
+
+		for _, err := range digest.check(h.Asserts) {
+			s.errs = append(s.errs, errors.Wrapf(err, "asserts[%v]", i))
+		}
+	}
+
+	if h.Asserts.Script != "" {
+		fn := fmt.Sprintf("%v_assertscript", prefix)
+		s.WriteScript(fn, h.Asserts.Script)
+		b, err := s.RunScript(fn)
+		if err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err,
+				"assert.script[%v]:\n%v: %v", i, h.Asserts.Script, string(b)))
+		} else {
+			if len(string(b)) > 0 {
+				log.Printf("asserts.script[%v]:\n%v", i, string(b))
+			}
+		}
+	}
+
+	return code
 }
 
-func doScenario(in *doScenarioInput) error {
-	commitSha, _ := in.Metadata["commit_sha"].(string)
-	for _, f := range in.ScenarioFiles {
-		startedAt := time.Now().UTC()
+// execute runs the prepare scripts, the 'run' entries, then the check scripts of
+// scenario file f. It returns true if the run was cancelled midway.
+func (s *Scenario) execute(f string) bool {
+	basef := filepath.Base(f)
+	for _, p := range s.prepares {
+		s.runBlock(basef, p)
+	}
 
-		if in.app != nil && in.RunID != "" && in.app.isRunCancelled(in.RunID, commitSha) {
-			log.Printf("doScenario: run_id=%s is cancelled, reporting skip for %s", in.RunID, f)
-			publishCancelledReport(in, f, startedAt)
+	cancelled := s.runSteps(f)
+
+	for _, c := range s.checks {
+		if s.FailFast && len(s.errs) > 0 {
+			log.Printf("%v: skipped, fail_fast", c.Name)
 			continue
 		}
 
-		yml, err := os.ReadFile(f)
-		if err != nil {
-			continue
+		s.runBlock(basef, c)
+	}
+
+	return cancelled
+}
+
+// runBlock writes a prepare/check script to disk and runs it. A non-zero return
+// value is appended to s.errs.
+func (s *Scenario) runBlock(basef string, ns namedScript) {
+	fn := filepath.Join(os.TempDir(), fmt.Sprintf("%v_%v", basef, ns.Name))
+	fn, _ = s.WriteScript(fn, ns.Script)
+	b, err := s.RunScript(fn)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err,
+			"%v:\n%v: %v", ns.Name, ns.Script, string(b)))
+	} else {
+		if len(string(b)) > 0 {
+			log.Printf("%v:\n%v", ns.Name, string(b))
 		}
+	}
+}
 
-		var s Scenario
-		err = yaml.Unmarshal(yml, &s)
-		if err != nil {
-			continue
+// runSteps executes the 'run' entries of scenario file f in order. It returns
+// true if the run was cancelled (or the service is shutting down) midway.
+func (s *Scenario) runSteps(f string) bool {
+	stop := s.FailFast && len(s.errs) > 0 // i.e. prepare failed
+	for i := range s.Run {
+		if s.interrupted(i, f) {
+			return true
 		}
 
-		if !isAllowed(&s) {
-			log.Printf("%v is not allowed by tags", f)
+		if stop {
+			log.Printf("run[%v]: skipped, fail_fast", i)
+			s.steps = append(s.steps, stepResult{Status: stepSkipped})
 			continue
 		}
 
-		s.me = &s    // self-reference for our LoggerReporter functions
-		s.input = in // our copy
-		log.Printf("scenario: %v", f)
+		basef := filepath.Base(f)
+		prefix := filepath.Join(os.TempDir(), fmt.Sprintf("%v_run%d", basef, i))
+		r := s.runStep(i, prefix, &s.Run[i])
+		s.steps = append(s.steps, r)
+		if r.Status == stepFailed && !s.Run[i].ContinueOnError {
+			stop = s.FailFast
+		}
+	}
 
-		if s.Prepare != "" {
-			basef := filepath.Base(f)
-			fn := filepath.Join(os.TempDir(), fmt.Sprintf("%v_prepare", basef))
-			fn, _ = s.WriteScript(fn, s.Prepare)
-			b, err := s.RunScript(fn)
-			if err != nil {
-				s.errs = append(s.errs, errors.Wrapf(err,
-					"prepare:\n%v: %v", s.Prepare, string(b)))
-			} else {
-				if len(string(b)) > 0 {
-					log.Printf("prepare:\n%v", string(b))
-				}
-			}
+	return false
+}
+
+// interrupted returns true if the run was cancelled, or the service is shutting
+// down, before step i of scenario file f.
+func (s *Scenario) interrupted(i int, f string) bool {
+	in := s.input
+	if s.runCtx().Err() != nil {
+		log.Printf("doScenario: run_id=%s cancelled mid-run at step %d of %s", in.RunID, i, f)
+		return true
+	}
+
+	if in.app == nil {
+		return false
+	}
+
+	if in.app.stopping() {
+		log.Printf("doScenario: shutting down, stopped at step %d of %s", i, f)
+		return true
+	}
+
+	commitSha, _ := in.Metadata["commit_sha"].(string)
+	if in.RunID != "" && in.app.isRunCancelled(in.RunID, commitSha) {
+		log.Printf("doScenario: run_id=%s cancelled mid-run at step %d of %s", in.RunID, i, f)
+		return true
+	}
+
+	return false
+}
+
+// runStep executes a single 'run' entry, honoring its 'when' condition and its
+// 'continue_on_error' setting.
+func (s *Scenario) runStep(i int, prefix string, run *Run) stepResult {
+	n := len(s.errs)
+	r := stepResult{Status: stepSuccess}
+	ok, err := true, error(nil)
+	if run.When != "" {
+		ok, err = s.evalWhen(run.When, fmt.Sprintf("%v_when", prefix))
+	}
+
+	switch {
+	case err != nil && run.ContinueOnError:
+		log.Printf("run[%v]: skipped, continue_on_error, ignoring when: %v: %v", i, run.When, err)
+		return stepResult{Status: stepSkipped}
+	case err != nil:
+		s.errs = append(s.errs, errors.Wrapf(err, "when[%v]: %v", i, run.When))
+	case !ok:
+		log.Printf("run[%v]: skipped, when: %v", i, run.When)
+		return stepResult{Status: stepSkipped}
+	case run.WebSocket != nil:
+		s.runWebSocket(i, prefix, run.WebSocket)
+	case run.SSE != nil:
+		s.runSSE(i, prefix, run.SSE)
+	default:
+		r.StatusCode = s.runHTTP(i, prefix, &run.HTTP)
+	}
+
+	if len(s.errs) > n {
+		r.Status = stepFailed
+		if run.ContinueOnError {
+			log.Printf("run[%v]: continue_on_error, ignoring: %v", i, s.errs[n:])
+			s.errs = s.errs[:n]
 		}
+	}
 
-		cancelledMidRun := false
-		for i, run := range s.Run {
-			if in.app != nil && in.RunID != "" && in.app.isRunCancelled(in.RunID, commitSha) {
-				log.Printf("doScenario: run_id=%s cancelled mid-run at step %d of %s", in.RunID, i, f)
-				cancelledMidRun = true
-				break
-			}
+	return r
+}
 
-			basef := filepath.Base(f)
-			prefix := filepath.Join(os.TempDir(), fmt.Sprintf("%v_run%d", basef, i))
+// evalWhen evaluates a step's 'when' condition. Script conditions ('#!') are
+// true if the script exits with zero.
+func (s *Scenario) evalWhen(when, file string) (bool, error) {
+	if !strings.HasPrefix(when, "#!") {
+		return evalCondition(when, s.lookupVar(s.steps))
+	}
 
-			// Parse url.
-			fn := fmt.Sprintf("%v_url", prefix)
-			nv, err := s.ParseValue(run.HTTP.URL, fn)
-			if err != nil {
-				s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, run.HTTP.URL))
-				continue
-			}
+	b, err := s.ParseValue(when, file)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			log.Printf("when: %v", b)
+			return false, nil
+		}
 
-			u, err := url.Parse(nv)
-			if err != nil {
-				s.errs = append(s.errs, errors.Wrapf(err, "url.Parse[%v]", i))
+		return false, err
+	}
+
+	return true, nil
+}
+
+// doScenario runs in.ScenarioFiles. In-flight requests and scripts are
+// interrupted when ctx is done, or when the run is cancelled.
+func doScenario(ctx context.Context, in *doScenarioInput) error {
+	// Suites live for the whole service in run mode; locally, only for this call.
+	suites := newSuiteCache()
+	if in.app != nil && in.app.suites != nil {
+		suites = in.app.suites
+	} else {
+		defer suites.teardownAll()
+	}
+
+	if in.app != nil && in.app.quarantine != nil {
+		in.quarantine = in.app.quarantine
+	} else if in.quarantine == nil {
+		in.quarantine = &quarantineList{}
+	}
+
+	for _, name := range in.ScenarioFiles {
+		file, selected := splitVariant(name)
+		variants, err := scenarioVariants(file)
+		if err != nil {
+			// Still reported, as it's counted in the run's total_scenarios.
+			log.Printf("%v: %v", file, err)
+			reportNotRun(in, name, fmt.Sprintf("load failed: %v", err))
+			continue
+		}
+
+		var found bool
+		for _, v := range variants {
+			if selected && v.Name != name {
 				continue
 			}
 
-			e := httpexpect.New(s, u.Scheme+"://"+u.Host)
-			req := e.Request(run.HTTP.Method, u.Path)
-			for k, v := range run.HTTP.Headers {
-				fn := fmt.Sprintf("%v_hdr.%v", prefix, k)
-				nv, err := s.ParseValue(v, fn)
-				if err != nil {
-					s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, v))
-					continue
-				}
+			found = true
+			runScenario(ctx, in, suites, file, v)
+		}
 
-				req = req.WithHeader(k, nv)
-				log.Printf("[header] %v: %v", k, nv)
-			}
+		if !found {
+			log.Printf("%v: no such variant", name)
+			reportNotRun(in, name, "no such variant")
+		}
+	}
 
-			for k, v := range run.HTTP.QueryParams {
-				fn := fmt.Sprintf("%v_qparams.%v", prefix, k)
-				nv, _ := s.ParseValue(v, fn)
-				req = req.WithQuery(k, nv)
-			}
+	return nil
+}
 
-			if len(run.HTTP.Files) > 0 {
-				req = req.WithMultipart()
-			}
-			for k, v := range run.HTTP.Files {
-				fn := fmt.Sprintf("%v_files.%v", prefix, k)
-				nv, _ := s.ParseValue(v, fn)
-				req = req.WithFile(k, nv)
-			}
+// reportNotRun reports scenario name as an error, for when it can't be run at
+// all, so that its run still completes.
+func reportNotRun(in *doScenarioInput, name, data string) {
+	publishStatusReport(in, name, time.Now().UTC(), "error", data, nil)
+	if in.OnScenarioDone != nil {
+		in.OnScenarioDone(name, "error")
+	}
+}
 
-			for k, v := range run.HTTP.Forms {
-				fn := fmt.Sprintf("%v_forms.%v", prefix, k)
-				nv, _ := s.ParseValue(v, fn)
-				req = req.WithFormField(k, nv)
-			}
+// runScenario runs a single variant of scenario file, then reports the result.
+func runScenario(ctx context.Context, in *doScenarioInput, suites *suiteCache, file string, v scenarioVariant) {
+	commitSha, _ := in.Metadata["commit_sha"].(string)
+	f := v.Name
+	startedAt := time.Now().UTC()
+	if in.app != nil {
+		in.app.inflight.Add(1)
+		defer in.app.inflight.Add(-1)
+	}
 
-			if run.HTTP.Payload != "" {
-				fn := fmt.Sprintf("%v_payload", prefix)
-				nv, _ := s.ParseValue(run.HTTP.Payload, fn)
-				req = req.WithBytes([]byte(nv))
-			}
+	if in.app != nil && in.RunID != "" && in.app.isRunCancelled(in.RunID, commitSha) {
+		log.Printf("doScenario: run_id=%s is cancelled, reporting skip for %s", in.RunID, f)
+		publishCancelledReport(in, f, startedAt, nil)
+		return
+	}
 
-			resp := req.Expect()
-			if run.HTTP.ResponseOut != "" {
-				body := resp.Body().Raw()
-				s.Write(run.HTTP.ResponseOut, []byte(body))
-				log.Printf("[response] %v", body)
-			}
+	if in.app != nil && in.app.stopping() {
+		log.Printf("doScenario: shutting down, reporting skip for %s", f)
+		publishInterruptedReport(in, f, startedAt, nil)
+		return
+	}
 
-			if run.HTTP.Asserts == nil {
-				continue
-			}
+	yml, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
 
-			resp = resp.Status(run.HTTP.Asserts.Code)
+	var s Scenario
+	err = yaml.Unmarshal(yml, &s)
+	if err != nil {
+		return
+	}
 
-			if run.HTTP.Asserts.ValidateJSON != "" {
-				resp.JSON().Schema(run.HTTP.Asserts.ValidateJSON)
-			}
+	if !isAllowedWithTags(&s, tags) {
+		log.Printf("%v is not allowed by tags", f)
+		return
+	}
 
-			if run.HTTP.Asserts.Script != "" {
-				fn := fmt.Sprintf("%v_assertscript", prefix)
-				s.WriteScript(fn, run.HTTP.Asserts.Script)
-				b, err := s.RunScript(fn)
-				if err != nil {
-					s.errs = append(s.errs, errors.Wrapf(err,
-						"assert.script[%v]:\n%v: %v", i, run.HTTP.Asserts.Script, string(b)))
-				} else {
-					if len(string(b)) > 0 {
-						log.Printf("asserts.script[%v]:\n%v", i, string(b))
-					}
+	s.me = &s    // self-reference for our LoggerReporter functions
+	s.input = in // our copy
+	s.ctx = ctx
+	if in.app != nil {
+		var stop func()
+		s.ctx, stop = in.app.watchRun(ctx, in.RunID, commitSha)
+		defer stop()
+	}
+
+	s.setParams(v.Params)
+	log.Printf("scenario: %v", f)
+
+	var cancelledMidRun bool
+	overlayDir, _ := in.Metadata["overlay_dir"].(string)
+	if err := s.resolveIncludes(file, overlayDir, 0); err != nil {
+		s.errs = append(s.errs, errors.Wrap(err, "include"))
+	} else if err := s.setupSuite(suites, file, overlayDir); err != nil {
+		s.errs = append(s.errs, errors.Wrap(err, "suite"))
+	} else {
+		cancelledMidRun = s.executeWithRetries(f)
+	}
+
+	// Cleanup always runs, and is reported separately from the scenario's result.
+	cleanupAttr := make(map[string]string)
+	if len(s.cleanups) > 0 {
+		cleanupAttr["cleanup_status"] = "success"
+		if errs := s.runCleanup(f); len(errs) > 0 {
+			log.Printf("cleanup errs: %v", errs)
+			cleanupAttr["cleanup_status"] = "error"
+			cleanupAttr["cleanup_data"] = fmt.Sprintf("%v", errs)
+			if in.ReportSlack != "" && !skipNotif {
+				payload := SlackMessage{
+					Attachments: []SlackAttachment{
+						{
+							Color:     "warning",
+							Title:     fmt.Sprintf("%v - cleanup failure", filepath.Base(f)),
+							Text:      fmt.Sprintf("Maintainers: %v\n%v", strings.Join(s.Maintainers, ", "), errs),
+							Footer:    "oops",
+							Timestamp: time.Now().Unix(),
+							MrkdwnIn:  []string{"text"},
+						},
+					},
+				}
+
+				if err := payload.Notify(in.ReportSlack); err != nil {
+					log.Printf("Notify (slack) failed: %v", err)
 				}
 			}
 		}
+	}
 
-		if s.Check != "" {
-			basef := filepath.Base(f)
-			fn := filepath.Join(os.TempDir(), fmt.Sprintf("%v_check", basef))
-			fn, _ = s.WriteScript(fn, s.Check)
-			b, err := s.RunScript(fn)
-			if err != nil {
-				s.errs = append(s.errs, errors.Wrapf(err,
-					"check:\n%v: %v", s.Check, string(b)))
-			} else {
-				if len(string(b)) > 0 {
-					log.Printf("check:\n%v", string(b))
-				}
+	if len(s.errs) > 0 {
+		log.Printf("errs: %v", s.errs)
+	}
+
+	// Failures of quarantined scenarios are reported as such, and don't fail the run.
+	status := "success"
+	quarantine := in.quarantine.lookup(&s, file)
+	if len(s.errs) > 0 {
+		status = "error"
+		if quarantine != nil {
+			log.Printf("%v: quarantined (%v), not counted as failure", f, quarantine.Reason)
+			status = "quarantined"
+		}
+	}
+
+	runCancelled := in.app != nil && in.RunID != "" && in.app.isRunCancelled(in.RunID, commitSha)
+	if cancelledMidRun && !runCancelled && in.app != nil && in.app.stopping() {
+		log.Printf("doScenario: shutting down, %s interrupted, reporting skip", f)
+		publishInterruptedReport(in, f, startedAt, cleanupAttr)
+		return
+	}
+
+	if cancelledMidRun || runCancelled {
+		log.Printf("doScenario: run_id=%s was cancelled during execution of %s, reporting skip", in.RunID, f)
+		publishCancelledReport(in, f, startedAt, cleanupAttr)
+		return
+	}
+
+	if in.ReportSlack != "" && !skipNotif && status == "error" {
+		text := fmt.Sprintf("Maintainers: %v\n%v", strings.Join(s.Maintainers, ", "), s.errs)
+		var skipped int
+		for _, r := range s.steps {
+			if r.Status == stepSkipped {
+				skipped++
 			}
 		}
 
-		if len(s.errs) > 0 {
-			log.Printf("errs: %v", s.errs)
+		if skipped > 0 {
+			text += fmt.Sprintf("\nSkipped steps: %d/%d", skipped, len(s.steps))
 		}
 
-		if cancelledMidRun || (in.app != nil && in.RunID != "" && in.app.isRunCancelled(in.RunID, commitSha)) {
-			log.Printf("doScenario: run_id=%s was cancelled during execution of %s, reporting skip", in.RunID, f)
-			publishCancelledReport(in, f, startedAt)
-			continue
+		if s.attempts > 1 {
+			text += fmt.Sprintf("\nAttempts: %d", s.attempts)
 		}
 
-		if in.ReportSlack != "" && !skipNotif && len(s.errs) > 0 {
-			payload := SlackMessage{
-				Attachments: []SlackAttachment{
-					{
-						Color:     "danger",
-						Title:     fmt.Sprintf("%v - failure", filepath.Base(f)),
-						Text:      fmt.Sprintf("Maintainers: %v\n%v", strings.Join(s.Maintainers, ", "), s.errs),
-						Footer:    "oops",
-						Timestamp: time.Now().Unix(),
-						MrkdwnIn:  []string{"text"},
-					},
+		payload := SlackMessage{
+			Attachments: []SlackAttachment{
+				{
+					Color:     "danger",
+					Title:     fmt.Sprintf("%v - failure", filepath.Base(f)),
+					Text:      text,
+					Footer:    "oops",
+					Timestamp: time.Now().Unix(),
+					MrkdwnIn:  []string{"text"},
 				},
-			}
+			},
+		}
 
-			err = payload.Notify(in.ReportSlack)
-			if err != nil {
-				log.Printf("Notify (slack) failed: %v", err)
-			}
+		err = payload.Notify(in.ReportSlack)
+		if err != nil {
+			log.Printf("Notify (slack) failed: %v", err)
 		}
+	}
 
-		if in.ReportPubsub != "" && in.app != nil {
-			if in.app.rpub != nil {
-				status := "success"
-				var data string
-				if len(s.errs) > 0 {
-					status = "error"
-					data = fmt.Sprintf("%v", s.errs)
-				}
+	if in.ReportPubsub != "" && in.app != nil {
+		if in.app.transport != nil {
+			var data string
+			if len(s.errs) > 0 {
+				data = fmt.Sprintf("%v", s.errs)
+			}
 
-				attr := make(map[string]string)
-				attr["started_at"] = startedAt.Format("2006-01-02 15:04:05")
+			attr := make(map[string]string)
+			attr["started_at"] = startedAt.Format("2006-01-02 15:04:05")
+			attr["duration_ms"] = fmt.Sprintf("%d", time.Since(startedAt).Milliseconds())
+			for k, v := range cleanupAttr {
+				attr[k] = v
+			}
 
-				if len(s.Maintainers) > 0 {
-					attr["maintainers"] = strings.Join(s.Maintainers, ",")
+			if quarantine != nil {
+				for k, v := range quarantine.attributes() {
+					attr[k] = v
 				}
+			}
 
-				if snssqs != "" {
-					attr["snssqs"] = snssqs
+			if s.attempts > 0 {
+				attr["attempts"] = fmt.Sprintf("%d", s.attempts)
+				if s.attempts > 1 && len(s.errs) == 0 {
+					attr["passed_on_retry"] = "true"
 				}
+			}
 
-				if pubsub != "" {
-					attr["pubsub"] = pubsub
+			if len(s.Maintainers) > 0 {
+				attr["maintainers"] = strings.Join(s.Maintainers, ",")
+			}
+
+			if len(s.steps) > 0 {
+				var steps []string
+				for _, r := range s.steps {
+					steps = append(steps, r.Status)
 				}
-				if in.Metadata != nil {
-					for _, key := range []string{
-						"pr_number", "branch", "commit_sha", "actor",
-						"trigger_type", "run_url", "repository", "workflow", "total_scenarios",
-						"rerun_mode", "pr_title", "commit_message",
-					} {
-						if v, ok := in.Metadata[key].(string); ok && v != "" {
-							attr[key] = v
-						}
+
+				attr["steps"] = strings.Join(steps, ",") // i.e. success,failed,skipped
+			}
+
+			if snssqs != "" {
+				attr["snssqs"] = snssqs
+			}
+
+			if pubsub != "" {
+				attr["pubsub"] = pubsub
+			}
+			if in.Metadata != nil {
+				for _, key := range []string{
+					"pr_number", "branch", "commit_sha", "actor",
+					"trigger_type", "run_url", "repository", "workflow", "total_scenarios",
+					"rerun_mode", "pr_title", "commit_message",
+				} {
+					if v, ok := in.Metadata[key].(string); ok && v != "" {
+						attr[key] = v
 					}
-					if ta, ok := in.Metadata["test_analysis"].(map[string]interface{}); ok {
-						for _, key := range []string{"missing_tests_in_pr", "should_run_tests"} {
-							if v, ok := ta[key].(bool); ok {
-								attr[key] = fmt.Sprintf("%v", v)
-							}
+				}
+				if ta, ok := in.Metadata["test_analysis"].(map[string]interface{}); ok {
+					for _, key := range []string{"missing_tests_in_pr", "should_run_tests"} {
+						if v, ok := ta[key].(bool); ok {
+							attr[key] = fmt.Sprintf("%v", v)
 						}
 					}
-
-					if b, err := json.Marshal(in.Metadata); err == nil {
-						attr["metadata"] = string(b)
-					}
 				}
 
-				r := ReportPubsub{
-					Scenario:   f,
-					Attributes: attr,
-					Status:     status,
-					Data:       data,
-					MessageID:  uuid.NewString(),
-					RunID:      in.RunID,
-					GroupID:    in.GroupID,
+				if b, err := json.Marshal(in.Metadata); err == nil {
+					attr["metadata"] = string(b)
 				}
+			}
 
-				err := in.app.rpub.Publish(r.MessageID, r)
-				if err != nil {
-					log.Printf("Publish failed: %v", err)
-				}
+			r := ReportPubsub{
+				Scenario:   f,
+				Attributes: attr,
+				Status:     status,
+				Data:       data,
+				MessageID:  uuid.NewString(),
+				RunID:      in.RunID,
+				GroupID:    in.GroupID,
 			}
-		}
 
-		if in.OnScenarioDone != nil {
-			status := "success"
-			if len(s.errs) > 0 {
-				status = "error"
+			err := in.app.transport.PublishReport(r)
+			if err != nil {
+				log.Printf("Publish failed: %v", err)
 			}
-			in.OnScenarioDone(f, status)
 		}
 	}
 
-	return nil
+	if in.OnScenarioDone != nil {
+		in.OnScenarioDone(f, status)
+	}
 }
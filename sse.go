@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SSEAsserts represents acceptance criteria for a single server-sent event.
+type SSEAsserts struct {
+	Event          string `yaml:"event"`
+	MessageAsserts `yaml:",inline"`
+}
+
+// RunSSE represents configuration on how to run Server-Sent Events test
+type RunSSE struct {
+	Method      string            `yaml:"method"`
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers"`
+	Payload     string            `yaml:"payload"`
+	Timeout     string            `yaml:"timeout"`
+	Events      int               `yaml:"events"`
+	ResponseOut string            `yaml:"response_out"`
+	Expect      []SSEAsserts      `yaml:"expect"`
+}
+
+// sseEvent is a single dispatched event from an event stream.
+type sseEvent struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+// readSSE parses the event stream in r until n events are dispatched, or r
+// returns an error (i.e. timeout). Events collected so far are always returned.
+func readSSE(r io.Reader, n int) ([]sseEvent, error) {
+	var out []sseEvent
+	var ev sseEvent
+	var data []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if len(data) == 0 {
+				ev = sseEvent{}
+				continue
+			}
+
+			ev.Data = strings.Join(data, "\n")
+			if ev.Event == "" {
+				ev.Event = "message"
+			}
+
+			out = append(out, ev)
+			if len(out) >= n {
+				return out, nil
+			}
+
+			ev, data = sseEvent{}, nil
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			ev.ID = value
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return out, err
+	}
+
+	return out, io.EOF
+}
+
+// runSSE executes the sse step at index i. Failures are appended to s.errs.
+func (s *Scenario) runSSE(i int, prefix string, h *RunSSE) {
+	fn := fmt.Sprintf("%v_url", prefix)
+	u, err := s.ParseValue(h.URL, fn)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, h.URL))
+		return
+	}
+
+	var body io.Reader
+	if h.Payload != "" {
+		fn := fmt.Sprintf("%v_payload", prefix)
+		nv, _ := s.ParseValue(h.Payload, fn)
+		body = strings.NewReader(nv)
+	}
+
+	method := h.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	timeout := parseTimeout(h.Timeout, defaultStreamTimeout)
+	ctx, cancel := context.WithTimeout(s.runCtx(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "http.NewRequest[%v]", i))
+		return
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	for k, v := range h.Headers {
+		fn := fmt.Sprintf("%v_hdr.%v", prefix, k)
+		nv, err := s.ParseValue(v, fn)
+		if err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, v))
+			continue
+		}
+
+		req.Header.Set(k, nv)
+		log.Printf("[header] %v: %v", k, nv)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "sse[%v]: %v", i, u))
+		return
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.errs = append(s.errs, fmt.Errorf("sse[%v]: unexpected status code %v", i, resp.StatusCode))
+		return
+	}
+
+	n := h.Events
+	if n <= 0 {
+		n = max(len(h.Expect), 1)
+	}
+
+	events, err := readSSE(resp.Body, n)
+	for _, ev := range events {
+		log.Printf("[sse] %v: %v", ev.Event, ev.Data)
+	}
+
+	if h.ResponseOut != "" {
+		b, _ := json.Marshal(events)
+		s.Write(h.ResponseOut, b)
+	}
+
+	if len(events) < n {
+		s.errs = append(s.errs, errors.Wrapf(err, "sse[%v]: got %d/%d events within %v", i, len(events), n, timeout))
+	}
+
+	for j, a := range h.Expect {
+		if j >= len(events) {
+			break
+		}
+
+		if a.Event != "" && a.Event != events[j].Event {
+			s.errs = append(s.errs, fmt.Errorf("sse.expect[%v][%v]: event %q, want %q", i, j, events[j].Event, a.Event))
+			continue
+		}
+
+		if err := matchMessage([]byte(events[j].Data), &a.MessageAsserts); err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err, "sse.expect[%v][%v]", i, j))
+			continue
+		}
+
+		if a.MessageOut != "" {
+			s.Write(a.MessageOut, []byte(events[j].Data))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test__readSSE(t *testing.T) {
+	stream := ": comment\n\nevent: tick\nid: 1\ndata: {\"n\":1}\n\ndata: line1\ndata: line2\n\ndata: last\n\n"
+	events, err := readSSE(strings.NewReader(stream), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v", events)
+	}
+
+	if events[0].Event != "tick" || events[0].ID != "1" || events[0].Data != `{"n":1}` {
+		t.Fatalf("unexpected event: %+v", events[0])
+	}
+
+	if events[1].Event != "message" || events[1].Data != "line1\nline2" {
+		t.Fatalf("unexpected event: %+v", events[1])
+	}
+
+	events, err = readSSE(strings.NewReader(stream), 5)
+	if err != io.EOF || len(events) != 3 {
+		t.Fatalf("expected 3 events and EOF, got %v, %v", events, err)
+	}
+}
+
+func Test__runSSE(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: hello\ndata: {\"user\":\"%v\"}\n\n", r.Header.Get("X-User"))
+		fmt.Fprint(w, "data: {\"n\":1}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // no more events
+	}))
+
+	defer ts.Close()
+	dir := t.TempDir()
+	s := Scenario{}
+	s.runSSE(0, filepath.Join(dir, "sse"), &RunSSE{
+		URL:         ts.URL,
+		Headers:     map[string]string{"X-User": "oops"},
+		ResponseOut: filepath.Join(dir, "events.json"),
+		Expect: []SSEAsserts{
+			{Event: "hello", MessageAsserts: MessageAsserts{Regex: `"user":"oops"`}},
+			{
+				Event: "message",
+				MessageAsserts: MessageAsserts{
+					ValidateJSON: `{"required":["n"]}`,
+					MessageOut:   filepath.Join(dir, "n.json"),
+				},
+			},
+		},
+	})
+
+	if len(s.errs) > 0 {
+		t.Fatal(s.errs)
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(dir, "n.json")); string(b) != `{"n":1}` {
+		t.Fatalf("unexpected message_out: %s", b)
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(dir, "events.json")); !strings.Contains(string(b), `"event":"hello"`) {
+		t.Fatalf("unexpected response_out: %s", b)
+	}
+
+	// Events that don't match.
+	s = Scenario{}
+	s.runSSE(0, filepath.Join(dir, "sse"), &RunSSE{
+		URL: ts.URL,
+		Expect: []SSEAsserts{
+			{Event: "bye"},
+			{MessageAsserts: MessageAsserts{Regex: "never"}},
+		},
+	})
+
+	if len(s.errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", s.errs)
+	}
+
+	// More events than the server sends, within the timeout.
+	s = Scenario{}
+	s.runSSE(0, filepath.Join(dir, "sse"), &RunSSE{
+		URL:     ts.URL,
+		Timeout: "200ms",
+		Events:  3,
+	})
+
+	if len(s.errs) != 1 || !strings.Contains(s.errs[0].Error(), "got 2/3 events") {
+		t.Fatalf("expected a timeout error, got %v", s.errs)
+	}
+}
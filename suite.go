@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Name of the suite file, searched from a scenario's directory upwards.
+const suiteFile = "suite.yaml"
+
+// Suite represents a suite.yaml file. Its setup runs once before the first
+// scenario of the suite, and its env (plus setup outputs) are shared with all
+// the scenarios of that suite.
+type Suite struct {
+	// Valid values: run (default) | worker
+	// run = setup once per run ID; teardown when a new run ID arrives
+	// worker = setup once per worker; teardown on shutdown
+	Scope    string            `yaml:"scope"`
+	Env      map[string]string `yaml:"env"`
+	Setup    string            `yaml:"setup"`
+	Teardown string            `yaml:"teardown"`
+}
+
+// suiteState is a suite whose setup has already run.
+type suiteState struct {
+	file  string
+	suite Suite
+	env   map[string]string // suite env + setup outputs
+	err   error             // setup failure, if any
+	in    *doScenarioInput
+}
+
+// suiteCache holds the suites set up so far, keyed by suite file.
+type suiteCache struct {
+	mtx    sync.Mutex
+	runID  string
+	suites map[string]*suiteState
+}
+
+func newSuiteCache() *suiteCache {
+	return &suiteCache{suites: make(map[string]*suiteState)}
+}
+
+// findSuite returns the nearest suite.yaml from scenario file upwards, without
+// leaving --dir (or the overlay dir). If the run has an overlay dir, an overlay
+// copy of the suite takes precedence over the baked-in one. Empty if none.
+func findSuite(file, overlayDir string) string {
+	absDir, _ := filepath.Abs(dir)
+	absOverlay, _ := filepath.Abs(overlayDir)
+	switch {
+	case overlayDir != "" && within(absOverlay, file):
+		if f := findSuiteUnder(absOverlay, file); f != "" {
+			return f
+		}
+
+		if dir == "" {
+			return ""
+		}
+
+		// An overlay scenario without an overlay suite uses the baked-in one.
+		rel, _ := filepath.Rel(absOverlay, file)
+		return findSuiteUnder(absDir, filepath.Join(absDir, rel))
+	case dir != "" && within(absDir, file):
+		f := findSuiteUnder(absDir, file)
+		if f != "" && overlayDir != "" {
+			rel, _ := filepath.Rel(absDir, f)
+			if o := filepath.Join(absOverlay, rel); fileExists(o) {
+				return o
+			}
+		}
+
+		return f
+	default:
+		// Without --dir, don't go above the service dir (services/<svc>/scenarios).
+		root := filepath.Dir(file)
+		for d := root; d != filepath.Dir(d); d = filepath.Dir(d) {
+			if filepath.Base(d) == "scenarios" {
+				root = filepath.Dir(d)
+				break
+			}
+		}
+
+		return findSuiteUnder(root, file)
+	}
+}
+
+// findSuiteUnder looks for suite.yaml from file's directory up to root.
+func findSuiteUnder(root, file string) string {
+	for d := filepath.Dir(file); ; d = filepath.Dir(d) {
+		if f := filepath.Join(d, suiteFile); fileExists(f) {
+			return f
+		}
+
+		if d == root || d == filepath.Dir(d) {
+			return ""
+		}
+	}
+}
+
+// within returns true if path is root itself or is under root.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// get returns the state of suite file, running its setup if needed. A new run
+// ID tears down (and forgets) all the 'run' scoped suites of the previous run.
+func (c *suiteCache) get(in *doScenarioInput, file string) *suiteState {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if in.RunID != c.runID {
+		c.teardown(func(st *suiteState) bool { return st.suite.Scope != "worker" })
+		c.runID = in.RunID
+	}
+
+	if st, ok := c.suites[file]; ok {
+		return st
+	}
+
+	st := &suiteState{file: file, in: in}
+	c.suites[file] = st
+	b, err := os.ReadFile(file)
+	if err != nil {
+		st.err = err
+		return st
+	}
+
+	if err := yaml.Unmarshal(b, &st.suite); err != nil {
+		st.err = err
+		return st
+	}
+
+	st.env = make(map[string]string)
+	for k, v := range st.suite.Env {
+		st.env[k] = v
+	}
+
+	if st.suite.Setup == "" {
+		return st
+	}
+
+	log.Printf("suite setup: %v", file)
+	outputs, err := st.runScript("setup", st.suite.Setup)
+	if err != nil {
+		st.err = err
+		return st
+	}
+
+	for k, v := range outputs {
+		st.env[k] = v
+	}
+
+	return st
+}
+
+// teardown runs the teardown script of the suites that match, then forgets them.
+func (c *suiteCache) teardown(match func(*suiteState) bool) {
+	for k, st := range c.suites {
+		if !match(st) {
+			continue
+		}
+
+		delete(c.suites, k)
+		if st.err != nil || st.suite.Teardown == "" {
+			continue
+		}
+
+		log.Printf("suite teardown: %v", st.file)
+		if _, err := st.runScript("teardown", st.suite.Teardown); err != nil {
+			log.Printf("suite teardown %v failed: %v", st.file, err)
+		}
+	}
+}
+
+// teardownAll tears down all the suites, i.e. on shutdown.
+func (c *suiteCache) teardownAll() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.teardown(func(*suiteState) bool { return true })
+}
+
+// runScript runs the suite's setup/teardown script. The script can export values
+// to the suite's scenarios by writing KEY=VALUE lines to the $OOPS_OUTPUT file.
+func (st *suiteState) runScript(name, script string) (map[string]string, error) {
+	out := filepath.Join(os.TempDir(), fmt.Sprintf("oops_%v", uuid.NewString()))
+	defer os.Remove(out)
+	s := &Scenario{Env: map[string]string{"OOPS_OUTPUT": out}, input: st.in}
+	for k, v := range st.env {
+		s.Env[k] = v
+	}
+
+	fn := filepath.Join(os.TempDir(), fmt.Sprintf("%v_%v", filepath.Base(filepath.Dir(st.file)), name))
+	fn, _ = s.WriteScript(fn, script)
+	b, err := s.RunScript(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "suite %v (%v): %v", name, st.file, string(b))
+	}
+
+	if len(b) > 0 {
+		log.Printf("suite %v:\n%v", name, string(b))
+	}
+
+	outputs := make(map[string]string)
+	f, err := os.Open(out)
+	if err != nil {
+		return outputs, nil // nothing exported
+	}
+
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if k, v, ok := strings.Cut(sc.Text(), "="); ok && k != "" {
+			outputs[strings.TrimSpace(k)] = v
+		}
+	}
+
+	return outputs, sc.Err()
+}
+
+// setupSuite sets up the suite of scenario file (if any) and adds the suite's env
+// to s, without overriding the scenario's own.
+func (s *Scenario) setupSuite(suites *suiteCache, file, overlayDir string) error {
+	sf := findSuite(file, overlayDir)
+	if sf == "" {
+		return nil
+	}
+
+	st := suites.get(s.input, sf)
+	if st.err != nil {
+		return st.err
+	}
+
+	s.mergeEnv(st.env)
+	return nil
+}
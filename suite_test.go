@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test__suiteCache(t *testing.T) {
+	root := t.TempDir()
+	sdir := filepath.Join(root, "services", "billing", "scenarios")
+	if err := os.MkdirAll(sdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(root, "log")
+	suite := `
+env:
+  REGION: us
+setup: |
+  #!/bin/sh
+  echo setup >> ` + log + `
+  echo "TENANT=t-$REGION" >> $OOPS_OUTPUT
+teardown: |
+  #!/bin/sh
+  echo "teardown $TENANT" >> ` + log + `
+`
+
+	if err := os.WriteFile(filepath.Join(root, "services", "billing", suiteFile), []byte(suite), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(sdir, "s.yaml")
+	sf := findSuite(file, "")
+	if sf != filepath.Join(root, "services", "billing", suiteFile) {
+		t.Fatalf("unexpected suite file: %v", sf)
+	}
+
+	suites := newSuiteCache()
+	for i := 0; i < 2; i++ {
+		s := &Scenario{Env: map[string]string{"REGION": "jp"}, input: &doScenarioInput{RunID: "run1"}}
+		if err := s.setupSuite(suites, file, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// Scenario env wins over the suite's.
+		if s.Env["TENANT"] != "t-us" || s.Env["REGION"] != "jp" {
+			t.Fatalf("unexpected env: %v", s.Env)
+		}
+	}
+
+	// A new run ID tears down the previous run's suite, then sets it up again.
+	suites.get(&doScenarioInput{RunID: "run2"}, sf)
+	suites.teardownAll()
+	b, _ := os.ReadFile(log)
+	want := "setup\nteardown t-us\nsetup\nteardown t-us\n"
+	if string(b) != want {
+		t.Fatalf("expected %q, got %q", want, string(b))
+	}
+
+	// Setup failures are cached, and fail the suite's scenarios.
+	os.WriteFile(sf, []byte("setup: |\n  #!/bin/sh\n  exit 1\n"), 0644)
+	s := &Scenario{input: &doScenarioInput{RunID: "run3"}}
+	if err := s.setupSuite(suites, file, ""); err == nil || !strings.Contains(err.Error(), "setup") {
+		t.Fatalf("expected setup error, got %v", err)
+	}
+}
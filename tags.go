@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// tagMatcher is a compiled tag expression, see parseTags.
+type tagMatcher func(tags map[string]string) bool
+
+// tagLexer lexes tag expressions. Words are anything else, i.e. globs.
+var tagLexer = exprLexer{
+	ops: []string{"(", ")", ",", "!", "=", "==", "!=", "&&", "||"},
+	word: func(c rune) bool {
+		return !unicode.IsSpace(c) && !strings.ContainsRune("()!,=&|'\"", c)
+	},
+}
+
+// tagKeyword returns true if t is the unquoted word w (case-insensitive).
+func tagKeyword(t exprToken, w string) bool {
+	return t.op == "" && !t.lit && strings.EqualFold(t.val, w)
+}
+
+// tagParser compiles tag expressions:
+//
+//	list  = or { "," or }                      (comma is the loosest AND)
+//	or    = and { ( "||" | "or" ) and }
+//	and   = not { ( "&&" | "and" ) not }
+//	not   = ( "!" | "not" ) not | "(" list ")" | term
+//	term  = key [ ( "=" | "==" | "!=" ) value | [ "not" ] "in" "(" value { "," value } ")" ]
+//
+// Values can be globs (i.e. env=prod*, team=*). A bare key checks for presence.
+type tagParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func (p *tagParser) peek() exprToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+
+	return exprToken{op: "eof"}
+}
+
+func (p *tagParser) list() (tagMatcher, error) {
+	l, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().op == "," {
+		p.pos++
+		r, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		l = tagAnd(l, r)
+	}
+
+	return l, nil
+}
+
+func (p *tagParser) or() (tagMatcher, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for t := p.peek(); t.op == "||" || tagKeyword(t, "or"); t = p.peek() {
+		p.pos++
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		l = tagOr(l, r)
+	}
+
+	return l, nil
+}
+
+func (p *tagParser) and() (tagMatcher, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+
+	for t := p.peek(); t.op == "&&" || tagKeyword(t, "and"); t = p.peek() {
+		p.pos++
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		l = tagAnd(l, r)
+	}
+
+	return l, nil
+}
+
+func (p *tagParser) not() (tagMatcher, error) {
+	t := p.peek()
+	switch {
+	case t.op == "!" || tagKeyword(t, "not"):
+		p.pos++
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(tags map[string]string) bool { return !m(tags) }, nil
+	case t.op == "(":
+		p.pos++
+		m, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek().op != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+
+		p.pos++
+		return m, nil
+	}
+
+	return p.term()
+}
+
+func (p *tagParser) word() (string, error) {
+	t := p.peek()
+	if t.op != "" {
+		if t.op == "eof" {
+			return "", fmt.Errorf("unexpected end of expression")
+		}
+
+		return "", fmt.Errorf("unexpected %q", t.op)
+	}
+
+	p.pos++
+	return t.val, nil
+}
+
+func (p *tagParser) term() (tagMatcher, error) {
+	key, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.op == "=" || t.op == "==" || t.op == "!=":
+		p.pos++
+		pattern, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+
+		g, err := tagGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		m := tagIn(key, []*regexp.Regexp{g})
+		if t.op == "!=" {
+			return func(tags map[string]string) bool { return !m(tags) }, nil
+		}
+
+		return m, nil
+	case tagKeyword(t, "in") || tagKeyword(t, "not"):
+		negate := tagKeyword(t, "not")
+		p.pos++
+		if negate && !tagKeyword(p.peek(), "in") {
+			return nil, fmt.Errorf("expecting 'in' after 'not'")
+		}
+
+		if negate {
+			p.pos++
+		}
+
+		if p.peek().op != "(" {
+			return nil, fmt.Errorf("expecting '(' after 'in'")
+		}
+
+		p.pos++
+		var patterns []*regexp.Regexp
+		for {
+			v, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+
+			g, err := tagGlob(v)
+			if err != nil {
+				return nil, err
+			}
+
+			patterns = append(patterns, g)
+			if p.peek().op != "," {
+				break
+			}
+
+			p.pos++
+		}
+
+		if p.peek().op != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+
+		p.pos++
+		m := tagIn(key, patterns)
+		if negate {
+			return func(tags map[string]string) bool { return !m(tags) }, nil
+		}
+
+		return m, nil
+	}
+
+	return func(tags map[string]string) bool {
+		_, ok := tags[key]
+		return ok
+	}, nil
+}
+
+// tagIn matches if tag key is present and its value matches any of the globs.
+func tagIn(key string, patterns []*regexp.Regexp) tagMatcher {
+	return func(tags map[string]string) bool {
+		v, ok := tags[key]
+		if !ok {
+			return false
+		}
+
+		for _, p := range patterns {
+			if p.MatchString(v) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// tagGlob compiles a tag value glob. The syntax is path.Match's, except that
+// '*' and '?' also match '/', since tag values aren't paths, i.e. 'team=a/*'
+// matches 'a/b/c'.
+func tagGlob(pattern string) (*regexp.Regexp, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%v: %v", pattern, err)
+	}
+
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '\\':
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			b.WriteByte('[')
+			i++
+			if pattern[i] == '^' {
+				b.WriteByte('^')
+				i++
+			}
+
+			for ; pattern[i] != ']'; i++ {
+				switch pattern[i] {
+				case '\\':
+					i++
+					b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+				case '-':
+					b.WriteByte('-')
+				default:
+					b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+				}
+			}
+
+			b.WriteByte(']')
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	b.WriteString(`)$`)
+	return regexp.Compile(b.String())
+}
+
+func tagAnd(l, r tagMatcher) tagMatcher {
+	return func(tags map[string]string) bool { return l(tags) && r(tags) }
+}
+
+func tagOr(l, r tagMatcher) tagMatcher {
+	return func(tags map[string]string) bool { return l(tags) || r(tags) }
+}
+
+// parseTags compiles tag filters, i.e. from --tags or the 'tags' field of the
+// start command. Each entry is a tag expression, and all entries must match.
+// Since --tags is comma-separated, the entries are joined back before parsing,
+// so 'env in (dev,stg)' survives the split. Empty filters match everything.
+func parseTags(filters []string) (tagMatcher, error) {
+	expr := strings.TrimSpace(strings.Join(filters, ","))
+	if expr == "" {
+		return func(map[string]string) bool { return true }, nil
+	}
+
+	toks, err := tagLexer.lex(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "tags %q", expr)
+	}
+
+	p := &tagParser{toks: toks}
+	m, err := p.list()
+	if err != nil {
+		return nil, errors.Wrapf(err, "tags %q", expr)
+	}
+
+	if p.pos < len(toks) {
+		return nil, fmt.Errorf("tags %q: unexpected token at %d", expr, p.pos)
+	}
+
+	return m, nil
+}
+
+// isAllowedWithTags returns true if the scenario's tags match the tag filters.
+// Invalid filters match nothing.
+func isAllowedWithTags(s *Scenario, tagFilters []string) bool {
+	m, err := parseTags(tagFilters)
+	if err != nil {
+		log.Printf("invalid tags: %v", err)
+		return false
+	}
+
+	return m(s.Tags)
+}
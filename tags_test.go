@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func Test__parseTags(t *testing.T) {
+	tags := map[string]string{"env": "prod-us", "team": "billing", "slow": "", "owner": "a/b/c"}
+	for _, tc := range []struct {
+		filters []string
+		want    bool
+	}{
+		{nil, true},
+		{[]string{"env=prod-us", "team=billing"}, true}, // classic AND of key=value
+		{[]string{"env=prod-us", "team=infra"}, false},
+		{[]string{"env=dev || team=billing"}, true},
+		{[]string{"env=dev or team=infra"}, false},
+		{[]string{"!slow"}, false},
+		{[]string{"not missing"}, true},
+		{[]string{"slow && team"}, true},
+		{[]string{"env!=prod-us"}, false},
+		{[]string{"missing!=x"}, true},
+		{[]string{"env=prod*"}, true},
+		{[]string{"env=*", "!missing=*"}, true},
+		{[]string{"team in (infra", "billing)"}, true}, // split by --tags
+		{[]string{"team not in (infra,billing)"}, false},
+		{[]string{"(env=dev || env=prod-*) && !(team=infra)"}, true},
+		{[]string{"team=billing || env=dev", "slow"}, true}, // comma is the loosest AND
+		{[]string{`team="billing"`}, true},
+		{[]string{"owner=a/*"}, true}, // '*' matches '/' too
+		{[]string{"owner=*/c"}, true},
+		{[]string{"owner=a/?/c"}, true},
+		{[]string{"owner=a/[ab]/c", "owner!=a/[^b]/*"}, true},
+		{[]string{"owner=a"}, false},
+	} {
+		m, err := parseTags(tc.filters)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.filters, err)
+		}
+
+		if got := m(tags); got != tc.want {
+			t.Errorf("%q: expected %v, got %v", tc.filters, tc.want, got)
+		}
+	}
+
+	for _, bad := range []string{"env=", "(env=dev", "env in dev", "a & b", "env=[", "team not (a)"} {
+		if _, err := parseTags([]string{bad}); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Max length of the error data printed per failed scenario.
+const tailDataMax = 300
+
+// formatReport returns the line printed by 'oops tail' for report r, i.e.
+// "[3/10] FAIL  1.2s  services/billing/scenarios/01.yaml".
+func formatReport(r ReportPubsub, n, total int) string {
+	progress := fmt.Sprintf("[%d]", n)
+	if total > 0 {
+		progress = fmt.Sprintf("[%d/%d]", n, total)
+	}
+
+	status := "PASS"
+	switch r.Status {
+	case "error":
+		status = "FAIL"
+	case "cancelled":
+		status = "CANCELLED"
+	case "interrupted":
+		status = "INTERRUPTED"
+	case "quarantined":
+		status = "QUARANTINED"
+	}
+
+	duration := "-"
+	if ms, err := strconv.ParseInt(r.Attributes["duration_ms"], 10, 64); err == nil {
+		duration = (time.Duration(ms) * time.Millisecond).Round(time.Millisecond * 100).String()
+	}
+
+	scenario := r.Scenario
+	if absDir, _ := filepath.Abs(dir); dir != "" && within(absDir, scenario) {
+		scenario, _ = filepath.Rel(absDir, scenario)
+	}
+
+	line := fmt.Sprintf("%v %-9v %8v  %v", progress, status, duration, scenario)
+	if (r.Status == "error" || r.Status == "quarantined") && r.Data != "" {
+		data := r.Data
+		if len(data) > tailDataMax {
+			data = data[:tailDataMax] + "..."
+		}
+
+		line += "\n    " + data
+	}
+
+	return line
+}
+
+// printSummary writes the final summary of w to out.
+func printSummary(out io.Writer, w *runWatch) string {
+	status, failed := w.summary()
+	n, total := w.counts()
+	fmt.Fprintf(out, "\n%v: %d/%d scenario(s) reported, %d failed\n", strings.ToUpper(status), n, total, len(failed))
+	for _, f := range failed {
+		fmt.Fprintf(out, "  failed: %v\n", f)
+	}
+
+	return status
+}
+
+func tailCmd() *cobra.Command {
+	var (
+		runID   string
+		groupID string
+		timeout time.Duration
+		sns     bool
+	)
+
+	tcmd := &cobra.Command{
+		Use:          "tail",
+		Short:        "Stream the results of a run",
+		SilenceUsage: true,
+		Long: `Stream the scenario results of a run (--run-id) or of a run and its reruns
+(--group-id) from --report-pubsub (over Pub/Sub, or SNS/NATS/Redis/Kafka with --sns/--nats/--redis/--kafka-brokers) as they finish. For a single run, exits after
+all of its scenarios are reported, or on a 'completed' message on --scenario-pubsub
+(if set), with a non-zero status if the run failed. Otherwise, runs until Ctrl-C.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			log.SetOutput(os.Stderr) // keep stdout for the results
+			if runID == "" && groupID == "" {
+				return fmt.Errorf("one of --run-id or --group-id is required")
+			}
+
+			if reppubsub == "" {
+				return fmt.Errorf("--report-pubsub is required")
+			}
+
+			var tr Transport
+			var err error
+			if sns {
+				tr, err = newSnsTransport("", "")
+			} else {
+				tr, err = newWatchTransport()
+			}
+
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			go func() {
+				sigch := make(chan os.Signal, 1)
+				signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+				<-sigch
+				cancel()
+			}()
+
+			w := newRunWatch(runID, groupID)
+			w.onReport = func(r ReportPubsub) {
+				n, total := w.counts()
+				fmt.Println(formatReport(r, n, total))
+			}
+
+			go func() {
+				if err := watchTopic(ctx, tr, reppubsub, nil, w.report); err != nil {
+					log.Printf("watch %v failed: %v", reppubsub, err)
+					cancel()
+				}
+			}()
+
+			if scenariopubsub != "" && runID != "" {
+				go func() {
+					if err := watchTopic(ctx, tr, scenariopubsub, nil, w.progress); err != nil {
+						log.Printf("watch %v failed: %v", scenariopubsub, err)
+					}
+				}()
+			}
+
+			done := w.done
+			if runID == "" {
+				done = nil // groups have no known total, tail until interrupted
+			}
+
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+
+			if status := printSummary(os.Stdout, w); status != "success" {
+				return fmt.Errorf("%v", status)
+			}
+
+			return nil
+		},
+	}
+
+	tcmd.Flags().SortFlags = false
+	tcmd.Flags().StringVar(&runID, "run-id", runID, "run ID to follow")
+	tcmd.Flags().StringVar(&groupID, "group-id", groupID, "group ID to follow (original run and its reruns)")
+	tcmd.Flags().StringVar(&scenariopubsub, "scenario-pubsub", os.Getenv("SCENARIO_PUBSUB"), "pubsub topic for scenario progress, to catch 'completed' messages")
+	tcmd.Flags().DurationVar(&timeout, "timeout", 0, "max time to tail, 0 means no limit")
+	tcmd.Flags().BoolVar(&sns, "sns", sns, "watch SNS topics (see --region) instead of Pub/Sub")
+	return tcmd
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/dchest/uniuri"
+	lspubsub "github.com/flowerinthenight/longsub/gcppubsub"
+	"github.com/pkg/errors"
+)
+
+// Transport carries the service's messages: the commands (start, process, etc.)
+// shared by all replicas, and the scenario reports.
+type Transport interface {
+	// Name describes the transport for logs and notifications, i.e. "pubsub=oops".
+	Name() string
+
+	// PublishCommand publishes c, to be processed by any one replica.
+	PublishCommand(c cmd) error
+
+	// Subscribe calls handler for each command, until ctx is done. A handler
+	// error means the command is redelivered, if the transport supports it.
+	Subscribe(ctx context.Context, handler func(data []byte) error) error
+
+	// PublishReport publishes a scenario report. A no-op if the transport has no
+	// report topic.
+	PublishReport(r ReportPubsub) error
+
+	// Publisher returns a publisher to topic, i.e. --scenario-pubsub.
+	Publisher(topic string) (publisher, error)
+
+	// SubscribeTopic calls handler for each message published to topic, until
+	// ctx is done. Subscribers with the same non-empty group share the messages
+	// (each is handled once, i.e. across replicas); with an empty group, the
+	// subscriber gets all messages from now on, i.e. for 'oops tail'. ready, if
+	// not nil, is called once subscribed, i.e. once the messages published from
+	// then on will be delivered.
+	SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error
+}
+
+// signalReady calls ready, if not nil; see Transport.SubscribeTopic.
+func signalReady(ready func()) {
+	if ready != nil {
+		ready()
+	}
+}
+
+// newTransport returns the Transport selected by the --pubsub, --snssqs, --nats,
+// --redis or --kafka-brokers flags.
+func newTransport() (Transport, error) {
+	var n int
+	for _, v := range []string{pubsub, snssqs, natsurl, redisurl, kafkabrokers} {
+		if v != "" {
+			n++
+		}
+	}
+
+	switch {
+	case n > 1:
+		return nil, fmt.Errorf("only one of --pubsub, --snssqs, --nats, --redis or --kafka-brokers can be set")
+	case pubsub != "":
+		return newPubsubTransport(project, pubsub, reppubsub)
+	case snssqs != "":
+		return newSnsTransport(snssqs, reppubsub)
+	case natsurl != "":
+		return newNatsTransport(natsurl, natsstream, reppubsub)
+	case redisurl != "":
+		return newRedisTransport(redisurl, redisstream, reppubsub)
+	case kafkabrokers != "":
+		return newKafkaTransport(strings.Split(kafkabrokers, ","), kafkatopic, reppubsub)
+	default:
+		return nil, fmt.Errorf("one of --pubsub, --snssqs, --nats, --redis or --kafka-brokers is required")
+	}
+}
+
+// newWatchTransport returns the Transport for watching the report and progress
+// topics, i.e. 'oops tail': NATS, Redis or Kafka if --nats, --redis or
+// --kafka-brokers is set, else Pub/Sub in --project-id.
+func newWatchTransport() (Transport, error) {
+	if natsurl != "" {
+		return newNatsTransport(natsurl, natsstream, "")
+	}
+
+	if redisurl != "" {
+		return newRedisTransport(redisurl, redisstream, "")
+	}
+
+	if kafkabrokers != "" {
+		return newKafkaTransport(strings.Split(kafkabrokers, ","), kafkatopic, "")
+	}
+
+	if project == "" {
+		return nil, fmt.Errorf("one of --project-id, --nats, --redis or --kafka-brokers is required")
+	}
+
+	return &pubsubTransport{project: project}, nil
+}
+
+// pubsubTransport is a Transport over GCP Pub/Sub, where the command topic and
+// its subscription have the same name.
+type pubsubTransport struct {
+	project string
+	topic   string
+	pub     *lspubsub.PubsubPublisher
+	rpub    *lspubsub.PubsubPublisher // nil if no report topic
+}
+
+func newPubsubTransport(project, topic, reportTopic string) (*pubsubTransport, error) {
+	t := &pubsubTransport{project: project, topic: topic}
+	var err error
+	t.pub, err = lspubsub.NewPubsubPublisher(project, topic)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create publisher %v failed", topic)
+	}
+
+	if reportTopic != "" {
+		t.rpub, err = lspubsub.NewPubsubPublisher(project, reportTopic)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create publisher %v failed", reportTopic)
+		}
+	}
+
+	return t, nil
+}
+
+func (t *pubsubTransport) Name() string { return fmt.Sprintf("pubsub=%v", t.topic) }
+
+func (t *pubsubTransport) PublishCommand(c cmd) error {
+	return t.pub.Publish(uniuri.NewLen(10), c)
+}
+
+func (t *pubsubTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	// Make sure topic/subscription is created.
+	_, topic, err := lspubsub.GetPublisher(t.project, t.topic)
+	if err != nil {
+		return errors.Wrapf(err, "publisher get/create for %v failed", t.topic)
+	}
+
+	_, err = lspubsub.GetSubscription(t.project, t.topic, topic, time.Second*60)
+	if err != nil {
+		return errors.Wrapf(err, "subscription get/create for %v failed", t.topic)
+	}
+
+	ls := lspubsub.NewLengthySubscriber(nil, t.project, t.topic, func(_ any, data []byte) error {
+		return handler(data)
+	})
+
+	return ls.Start(ctx)
+}
+
+func (t *pubsubTransport) PublishReport(r ReportPubsub) error {
+	if t.rpub == nil {
+		return nil
+	}
+
+	return t.rpub.Publish(r.MessageID, r)
+}
+
+func (t *pubsubTransport) Publisher(topic string) (publisher, error) {
+	return lspubsub.NewPubsubPublisher(t.project, topic)
+}
+
+// SubscribeTopic uses the subscription named group, or a temporary one (deleted
+// on return) for an empty group.
+func (t *pubsubTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	_, rt, err := lspubsub.GetPublisher(t.project, topic)
+	if err != nil {
+		return errors.Wrapf(err, "publisher get/create for %v failed", topic)
+	}
+
+	if group == "" {
+		// Created first, so messages are kept from the time we're ready.
+		sub := fmt.Sprintf("%v-watch-%v", topic, strings.ToLower(uniuri.NewLen(8)))
+		_, err = lspubsub.GetSubscription(t.project, sub, rt, time.Second*60)
+		if err != nil {
+			return errors.Wrapf(err, "subscription get/create for %v failed", sub)
+		}
+
+		defer func() {
+			if err := lspubsub.DelSubscription(t.project, sub); err != nil {
+				log.Printf("delete subscription %v failed: %v", sub, err)
+			}
+		}()
+
+		signalReady(ready)
+		return lspubsub.Do(ctx, lspubsub.DoArgs{
+			ProjectId:              t.project,
+			TopicId:                topic,
+			SubscriptionId:         sub,
+			MaxOutstandingMessages: 10,
+			ReceiveCallback: func(ctx context.Context, m *gpubsub.Message) {
+				handler(m.Data)
+				m.Ack()
+			},
+		})
+	}
+
+	_, err = lspubsub.GetSubscription(t.project, group, rt, time.Second*60)
+	if err != nil {
+		return errors.Wrapf(err, "subscription get/create for %v failed", group)
+	}
+
+	signalReady(ready)
+
+	ls := lspubsub.NewLengthySubscriber(nil, t.project, group, func(_ any, data []byte) error {
+		return handler(data)
+	})
+
+	return ls.Start(ctx)
+}
+
+// snsTransport is a Transport over AWS SNS, with an SQS queue (same name as the
+// topic) subscribed to it. Topics (reports and progress) are SNS topics too, each
+// subscriber group with its own queue, and watchers with a temporary one.
+type snsTransport struct {
+	topic     string
+	topicArn  *string
+	reportArn *string // nil if no report topic
+	svc       snsiface.SNSAPI
+	sqs       sqsiface.SQSAPI
+}
+
+// newSnsTransport returns an SNS/SQS transport for commands on topic and reports
+// on reportTopic (optional). Without topic, it's for watching topics only.
+func newSnsTransport(topic, reportTopic string) (*snsTransport, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &snsTransport{topic: topic, svc: sns.New(sess), sqs: sqs.New(sess)}
+	if topic != "" {
+		t.topicArn, err = snsTopic(t.svc, topic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if reportTopic != "" {
+		t.reportArn, err = snsTopic(t.svc, reportTopic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *snsTransport) Name() string { return fmt.Sprintf("sns/sqs=%v", t.topic) }
+
+func (t *snsTransport) publish(arn *string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.svc.Publish(&sns.PublishInput{
+		TopicArn: arn,
+		Subject:  aws.String(uniuri.NewLen(10)),
+		Message:  aws.String(string(b)),
+	})
+
+	return err
+}
+
+func (t *snsTransport) PublishCommand(c cmd) error { return t.publish(t.topicArn, c) }
+
+func (t *snsTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	if _, err := sqsSubscribe(t.svc, t.sqs, t.topicArn, t.topic); err != nil {
+		return err
+	}
+
+	log.Printf("%v subscribed to %v", t.topic, t.topic)
+	return sqsListen(ctx, t.sqs, t.topic, handler)
+}
+
+func (t *snsTransport) PublishReport(r ReportPubsub) error {
+	if t.reportArn == nil {
+		return nil
+	}
+
+	return t.publish(t.reportArn, r)
+}
+
+type snsPublisher struct {
+	t   *snsTransport
+	arn *string
+}
+
+func (p snsPublisher) Publish(key string, data interface{}) error { return p.t.publish(p.arn, data) }
+
+func (t *snsTransport) Publisher(topic string) (publisher, error) {
+	arn, err := snsTopic(t.svc, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return snsPublisher{t: t, arn: arn}, nil
+}
+
+// SubscribeTopic uses the SQS queue named group, subscribed to topic, or a
+// temporary one (unsubscribed and deleted on return) for an empty group.
+func (t *snsTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	arn, err := snsTopic(t.svc, topic)
+	if err != nil {
+		return err
+	}
+
+	if group != "" {
+		if _, err := sqsSubscribe(t.svc, t.sqs, arn, group); err != nil {
+			return err
+		}
+
+		signalReady(ready)
+		return sqsListen(ctx, t.sqs, group, handler)
+	}
+
+	queue := fmt.Sprintf("%v-watch-%v", topic, strings.ToLower(uniuri.NewLen(8)))
+	sub, err := sqsSubscribe(t.svc, t.sqs, arn, queue)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if _, err := t.svc.Unsubscribe(&sns.UnsubscribeInput{SubscriptionArn: sub}); err != nil {
+			log.Printf("unsubscribe %v failed: %v", queue, err)
+		}
+
+		if err := sqsDelete(t.sqs, queue); err != nil {
+			log.Printf("delete queue %v failed: %v", queue, err)
+		}
+	}()
+
+	signalReady(ready)
+	return sqsListen(ctx, t.sqs, queue, handler)
+}
+
+// memTransport is an in-process Transport, i.e. for tests. Messages are queued
+// in memory per topic (no redelivery), all subscribers of a topic share them,
+// and reports are also kept, and passed to onReport.
+type memTransport struct {
+	mtx         sync.Mutex
+	topics      map[string]*memTopic
+	reportTopic string // optional
+	reports     []ReportPubsub
+	onReport    func(ReportPubsub) // optional
+}
+
+type memTopic struct {
+	queue  [][]byte
+	signal chan struct{}
+}
+
+// The memTransport topic for commands.
+const memCommands = "commands"
+
+func newMemTransport() *memTransport {
+	return &memTransport{topics: make(map[string]*memTopic)}
+}
+
+func (t *memTransport) topic(name string) *memTopic {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.topics[name]; !ok {
+		t.topics[name] = &memTopic{signal: make(chan struct{}, 1)}
+	}
+
+	return t.topics[name]
+}
+
+func (t *memTransport) publish(topic string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	q := t.topic(topic)
+	t.mtx.Lock()
+	q.queue = append(q.queue, b)
+	t.mtx.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// next pops the oldest queued message of q, if any.
+func (t *memTransport) next(q *memTopic) ([]byte, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(q.queue) == 0 {
+		return nil, false
+	}
+
+	b := q.queue[0]
+	q.queue = q.queue[1:]
+	return b, true
+}
+
+func (t *memTransport) Name() string { return "memory" }
+
+func (t *memTransport) PublishCommand(c cmd) error { return t.publish(memCommands, c) }
+
+func (t *memTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	return t.SubscribeTopic(ctx, memCommands, memCommands, nil, handler)
+}
+
+func (t *memTransport) PublishReport(r ReportPubsub) error {
+	t.mtx.Lock()
+	t.reports = append(t.reports, r)
+	fn := t.onReport
+	t.mtx.Unlock()
+	if fn != nil {
+		fn(r)
+	}
+
+	if t.reportTopic == "" {
+		return nil
+	}
+
+	return t.publish(t.reportTopic, r)
+}
+
+// Reports returns the reports published so far.
+func (t *memTransport) Reports() []ReportPubsub {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return append([]ReportPubsub{}, t.reports...)
+}
+
+type memPublisher struct {
+	t     *memTransport
+	topic string
+}
+
+func (p memPublisher) Publish(key string, data interface{}) error { return p.t.publish(p.topic, data) }
+
+func (t *memTransport) Publisher(topic string) (publisher, error) {
+	return memPublisher{t: t, topic: topic}, nil
+}
+
+// SubscribeTopic ignores group: there is a single consumer per topic message.
+func (t *memTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	q := t.topic(topic)
+	signalReady(ready)
+	for {
+		for b, ok := t.next(q); ok; b, ok = t.next(q) {
+			if err := handler(b); err != nil {
+				log.Printf("memory: %v: handler failed, dropped: %v", topic, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.signal:
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// Test__memTransport runs start -> distribute -> process -> report -> aggregate
+// in one process, over the in-memory transport.
+func Test__memTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer ts.Close()
+	root := t.TempDir()
+	scenario := func(path string) string {
+		return "run:\n- http: {method: GET, url: " + ts.URL + path + ", asserts: {status_code: 200}}\n"
+	}
+
+	writeTestFile(t, root, "services/billing/scenarios/01.yaml", scenario("/ok"))
+	writeTestFile(t, root, "services/billing/scenarios/02.yaml", scenario("/fail"))
+	writeTestFile(t, root, "services/users/scenarios/01.yaml", scenario("/ok"))
+
+	defer func(d, r string) { dir, reppubsub = d, r }(dir, reppubsub)
+	dir, reppubsub = root, "reports"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := newMemTransport()
+	app := &appctx{
+		ctx:       ctx,
+		transport: tr,
+		mtx:       &sync.Mutex{},
+		suites:    newSuiteCache(),
+		results:   newMemResultStore(),
+	}
+
+	pub := &fakePublisher{}
+	agg := &aggregator{store: app.results, pub: pub}
+	completed := make(chan struct{})
+	tr.onReport = func(r ReportPubsub) {
+		b, _ := json.Marshal(r)
+		agg.handleReport(nil, b)
+		if n := len(pub.msgs); n > 0 && pub.msgs[n-1].Code == "completed" {
+			close(completed)
+		}
+	}
+
+	go tr.Subscribe(ctx, func(data []byte) error { return process(app, data) })
+	err := tr.PublishCommand(cmd{
+		Code: "start",
+		ID:   "run1",
+		Metadata: map[string]interface{}{
+			"test_analysis": map[string]interface{}{"affected_services": "billing"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-completed:
+	case <-time.After(time.Second * 10):
+		t.Fatalf("timed out, reports: %v", tr.Reports())
+	}
+
+	reports := tr.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %v", reports)
+	}
+
+	done := pub.msgs[len(pub.msgs)-1]
+	failed := filepath.Join(root, "services/billing/scenarios/02.yaml")
+	if done.OverallStatus != "failure" || len(done.FailedScenarios) != 1 || done.FailedScenarios[0] != failed {
+		t.Fatalf("unexpected completed message: %+v", done)
+	}
+}
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(in *sns.PublishInput) (*sns.PublishOutput, error) {
+	f.published = append(f.published, in)
+	return &sns.PublishOutput{}, nil
+}
+
+// Test__snsTransport checks that reports, progress and cancelled reports reach
+// their SNS topics.
+func Test__snsTransport(t *testing.T) {
+	svc := &fakeSNS{}
+	tr := &snsTransport{
+		topic:     "oops",
+		topicArn:  aws.String("arn:oops"),
+		reportArn: aws.String("arn:reports"),
+		svc:       svc,
+	}
+
+	if err := tr.PublishCommand(cmd{Code: "process", ID: "run1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.PublishReport(ReportPubsub{Scenario: "s.yaml", RunID: "run1", Status: "success"}); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := snsPublisher{t: tr, arn: aws.String("arn:progress")}
+	if err := progress.Publish("key", ScenarioProgressMessage{RunID: "run1", Code: "completed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	in := &doScenarioInput{app: &appctx{transport: tr}, ReportPubsub: "reports", RunID: "run1"}
+	publishCancelledReport(in, "c.yaml", time.Now(), nil)
+
+	want := []string{"arn:oops", "arn:reports", "arn:progress", "arn:reports"}
+	if len(svc.published) != len(want) {
+		t.Fatalf("expected %v publishes, got %v", len(want), len(svc.published))
+	}
+
+	for i, p := range svc.published {
+		if *p.TopicArn != want[i] {
+			t.Errorf("publish %v: got topic %v, want %v", i, *p.TopicArn, want[i])
+		}
+	}
+
+	var r ReportPubsub
+	if err := json.Unmarshal([]byte(*svc.published[3].Message), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Scenario != "c.yaml" || r.Status != "cancelled" || r.RunID != "run1" {
+		t.Fatalf("unexpected cancelled report %+v", r)
+	}
+
+	// Without a report topic, reports are dropped.
+	tr.reportArn = nil
+	if err := tr.PublishReport(ReportPubsub{RunID: "run1"}); err != nil || len(svc.published) != len(want) {
+		t.Fatalf("expected no publish, got %v (err=%v)", len(svc.published), err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// readMetadata reads a JSON object from file, or stdin if file is '-'.
+func readMetadata(file string) (map[string]interface{}, error) {
+	metadata := make(map[string]interface{})
+	if file == "" {
+		return metadata, nil
+	}
+
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(file)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	return metadata, nil
+}
+
+func triggerCmd() *cobra.Command {
+	var (
+		code         string
+		rerunOf      string
+		scenarios    []string
+		id           string
+		groupID      string
+		metadataFile string
+		meta         map[string]string
+		affected     []string
+		wait         bool
+		timeout      time.Duration
+	)
+
+	tcmd := &cobra.Command{
+		Use:          "trigger",
+		Short:        "Start a run on the service",
+		SilenceUsage: true,
+		Long: `Publish a start, start_all, rerun or cancel command to the same --pubsub or --snssqs topic the
+'run' service listens to. A cancel command records the cancellation of --id (and/or
+--meta commit_sha=...) in the service's --cancel-store. With --wait, follow the run's reports on --report-pubsub
+(and 'completed' messages on --scenario-pubsub, if set) and exit with its status.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			log.SetOutput(os.Stderr) // keep stdout for the run ID
+			switch code {
+			case "start", "start_all":
+			case "rerun_failed", "rerun_scenarios":
+				if rerunOf == "" && groupID == "" {
+					return fmt.Errorf("%v needs --rerun-of or --group-id", code)
+				}
+
+				if code == "rerun_scenarios" && len(scenarios) == 0 {
+					return fmt.Errorf("rerun_scenarios needs --rerun-scenarios")
+				}
+			case "cancel":
+				if wait {
+					return fmt.Errorf("--wait is not supported for cancel")
+				}
+			default:
+				return fmt.Errorf("unsupported --code %q, expecting start, start_all, rerun_failed, rerun_scenarios or cancel", code)
+			}
+
+			if _, err := parseTags(tags); err != nil {
+				return err
+			}
+
+			if wait && reppubsub == "" {
+				return fmt.Errorf("--wait needs --report-pubsub")
+			}
+
+			metadata, err := readMetadata(metadataFile)
+			if err != nil {
+				return err
+			}
+
+			tr, err := newTransport()
+			if err != nil {
+				return err
+			}
+
+			for k, v := range meta {
+				metadata[k] = v
+			}
+
+			if sha, _ := metadata["commit_sha"].(string); code == "cancel" && id == "" && sha == "" {
+				return fmt.Errorf("cancel needs --id or a commit_sha in the metadata")
+			}
+
+			if len(affected) > 0 {
+				ta, _ := metadata["test_analysis"].(map[string]interface{})
+				if ta == nil {
+					ta = make(map[string]interface{})
+				}
+
+				ta["affected_services"] = strings.Join(affected, ",")
+				metadata["test_analysis"] = ta
+			}
+
+			// The service expects a trigger_type for its Slack notification.
+			if _, ok := metadata["trigger_type"].(string); !ok {
+				metadata["trigger_type"] = "manual"
+			}
+
+			if id == "" && code != "cancel" {
+				id = uuid.NewString()
+			}
+
+			if groupID == "" && rerunOf == "" {
+				groupID = id // reruns default to the prior run's group
+			}
+
+			c := cmd{
+				Code:      code,
+				ID:        id,
+				Tags:      tags,
+				Metadata:  metadata,
+				GroupID:   groupID,
+				RerunOf:   rerunOf,
+				Scenarios: scenarios,
+			}
+
+			var w *runWatch
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if wait {
+				if timeout > 0 {
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+
+				w = newRunWatch(id, "")
+				w.onReport = func(r ReportPubsub) {
+					n, total := w.counts()
+					log.Println(formatReport(r, n, total))
+				}
+
+				// Publish only once subscribed, so we don't miss early reports.
+				watches := map[string]func(data []byte){reppubsub: w.report}
+				if scenariopubsub != "" {
+					watches[scenariopubsub] = w.progress
+				}
+
+				if err := watchTopics(ctx, tr, watches); err != nil {
+					return err
+				}
+			}
+
+			if err := tr.PublishCommand(c); err != nil {
+				return err
+			}
+
+			b, _ := json.Marshal(c)
+			log.Printf("published: %v", string(b))
+			fmt.Println(id)
+			if !wait {
+				return nil
+			}
+
+			select {
+			case <-w.done:
+			case <-ctx.Done():
+				return fmt.Errorf("run %v: timed out waiting for completion", id)
+			}
+
+			status, failed := w.summary()
+			log.Printf("run %v: %v, %d scenario(s), %d failed", id, status, len(w.results), len(failed))
+			for _, f := range failed {
+				log.Printf("failed: %v", f)
+			}
+
+			if status != "success" {
+				return fmt.Errorf("run %v: %v", id, status)
+			}
+
+			return nil
+		},
+	}
+
+	tcmd.Flags().SortFlags = false
+	tcmd.Flags().StringVar(&code, "code", "start", "command code: start, start_all, rerun_failed, rerun_scenarios, cancel")
+	tcmd.Flags().StringVar(&id, "id", id, "run ID, generated if empty")
+	tcmd.Flags().StringVar(&groupID, "group-id", groupID, "group ID linking a run and its reruns, defaults to the run ID")
+	tcmd.Flags().StringVar(&rerunOf, "rerun-of", rerunOf, "prior run ID, for the rerun codes")
+	tcmd.Flags().StringSliceVar(&scenarios, "rerun-scenarios", scenarios, "scenarios to rerun (absolute, or relative to the service's --dir), for rerun_scenarios")
+	tcmd.Flags().StringVar(&metadataFile, "metadata", metadataFile, "JSON file ('-' for stdin) with the run metadata")
+	tcmd.Flags().StringToStringVar(&meta, "meta", meta, "additional metadata, i.e. --meta repository=org/repo,commit_sha=abc")
+	tcmd.Flags().StringSliceVar(&affected, "affected-services", affected, "affected services (test_analysis.affected_services), for the start code")
+	tcmd.Flags().StringVar(&pubsub, "pubsub", pubsub, "name of the GCP pubsub topic the service listens to")
+	tcmd.Flags().StringVar(&snssqs, "snssqs", snssqs, "name of the SNS topic the service listens to")
+	tcmd.Flags().StringVar(&scenariopubsub, "scenario-pubsub", os.Getenv("SCENARIO_PUBSUB"), "pubsub topic for scenario progress, to catch 'completed' messages with --wait")
+	tcmd.Flags().BoolVar(&wait, "wait", wait, "wait for the run to complete, exit non-zero if it fails")
+	tcmd.Flags().DurationVar(&timeout, "timeout", time.Minute*30, "max wait with --wait, 0 means no limit")
+	return tcmd
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// runWatch follows the reports (and progress messages) of a single run, or of
+// all the runs of a group, until all of its scenarios are done.
+type runWatch struct {
+	runID   string
+	groupID string
+
+	// Optional, called for each report of the run.
+	onReport func(r ReportPubsub)
+
+	mtx       sync.Mutex
+	total     int                     // from total_scenarios, 0 if not known yet
+	results   map[string]ReportPubsub // latest report per scenario
+	completed *ScenarioProgressMessage
+	done      chan struct{}
+	once      sync.Once
+}
+
+func newRunWatch(runID, groupID string) *runWatch {
+	return &runWatch{
+		runID:   runID,
+		groupID: groupID,
+		results: make(map[string]ReportPubsub),
+		done:    make(chan struct{}),
+	}
+}
+
+func (w *runWatch) match(runID, groupID string) bool {
+	return (w.runID != "" && runID == w.runID) || (w.groupID != "" && groupID == w.groupID)
+}
+
+// report handles a ReportPubsub message from the report topic.
+func (w *runWatch) report(data []byte) {
+	var r ReportPubsub
+	if err := json.Unmarshal(data, &r); err != nil || !w.match(r.RunID, r.GroupID) {
+		return
+	}
+
+	w.mtx.Lock()
+	if n, err := strconv.Atoi(r.Attributes["total_scenarios"]); err == nil && n > w.total {
+		w.total = n
+	}
+
+	w.results[r.Scenario] = r
+	finished := w.total > 0 && len(w.results) >= w.total
+	w.mtx.Unlock()
+	if w.onReport != nil {
+		w.onReport(r)
+	}
+
+	if finished {
+		w.once.Do(func() { close(w.done) })
+	}
+}
+
+// progress handles a ScenarioProgressMessage from the progress topic. Only the
+// 'completed' and 'cancelled' codes end the watch.
+func (w *runWatch) progress(data []byte) {
+	var msg ScenarioProgressMessage
+	if err := json.Unmarshal(data, &msg); err != nil || !w.match(msg.RunID, "") {
+		return
+	}
+
+	switch msg.Code {
+	case "completed", "cancelled":
+		w.mtx.Lock()
+		w.completed = &msg
+		w.mtx.Unlock()
+		w.once.Do(func() { close(w.done) })
+	}
+}
+
+// counts returns the number of scenarios reported so far, and the expected total
+// (0 if not known yet).
+func (w *runWatch) counts() (int, int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return len(w.results), w.total
+}
+
+// summary returns the aggregated status of the run (success, failure or
+// cancelled), and the failed scenarios.
+func (w *runWatch) summary() (string, []string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	var failed []string
+	var cancelled bool
+	for f, r := range w.results {
+		switch r.Status {
+		case "error", "interrupted":
+			failed = append(failed, f)
+		case "cancelled":
+			cancelled = true
+		}
+	}
+
+	sort.Strings(failed)
+	switch {
+	case w.completed != nil && w.completed.Code == "cancelled":
+		return "cancelled", failed
+	case w.completed != nil:
+		if len(w.completed.FailedScenarios) > 0 {
+			failed = w.completed.FailedScenarios
+		}
+
+		if w.completed.OverallStatus == "failure" || w.completed.FailedCount > 0 || len(failed) > 0 {
+			return "failure", failed
+		}
+
+		return "success", failed
+	case len(failed) > 0:
+		return "failure", failed
+	case cancelled:
+		return "cancelled", failed
+	default:
+		return "success", failed
+	}
+}
+
+// watchTopics starts watchTopic for each topic, with its fn, and returns once all
+// are subscribed, or the first error (or ctx's, if done before then).
+func watchTopics(ctx context.Context, tr Transport, topics map[string]func(data []byte)) error {
+	ready := make(chan error, len(topics))
+	for topic, fn := range topics {
+		var once sync.Once
+		done := func(err error) { once.Do(func() { ready <- err }) }
+		go func(topic string, fn func(data []byte)) {
+			err := watchTopic(ctx, tr, topic, func() { done(nil) }, fn)
+			if err != nil {
+				log.Printf("watch %v failed: %v", topic, err)
+				done(errors.Wrapf(err, "watch %v", topic))
+			}
+
+			done(errors.Errorf("watch %v: stopped before subscribing", topic))
+		}(topic, fn)
+	}
+
+	for range topics {
+		select {
+		case err := <-ready:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for subscriptions")
+		}
+	}
+
+	return nil
+}
+
+// watchTopic calls fn for each message published to topic until ctx is done,
+// without taking messages from the service's subscribers. ready, if not nil, is
+// called once subscribed.
+func watchTopic(ctx context.Context, tr Transport, topic string, ready func(), fn func(data []byte)) error {
+	return tr.SubscribeTopic(ctx, topic, "", ready, func(data []byte) error {
+		fn(data)
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test__runWatch(t *testing.T) {
+	report := func(w *runWatch, runID, scenario, status string) {
+		b, _ := json.Marshal(ReportPubsub{
+			Scenario:   scenario,
+			Status:     status,
+			RunID:      runID,
+			Attributes: map[string]string{"total_scenarios": "2"},
+		})
+
+		w.report(b)
+	}
+
+	finished := func(w *runWatch) bool {
+		select {
+		case <-w.done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	w := newRunWatch("run1", "")
+	report(w, "other", "a.yaml", "error") // not ours
+	report(w, "run1", "a.yaml", "success")
+	if finished(w) {
+		t.Fatal("expected not finished after 1/2")
+	}
+
+	report(w, "run1", "b.yaml", "error")
+	if !finished(w) {
+		t.Fatal("expected finished after 2/2")
+	}
+
+	status, failed := w.summary()
+	if status != "failure" || !reflect.DeepEqual(failed, []string{"b.yaml"}) {
+		t.Fatalf("unexpected summary: %v %v", status, failed)
+	}
+
+	// A 'completed' progress message ends the watch, with its own status.
+	w = newRunWatch("run2", "")
+	b, _ := json.Marshal(ScenarioProgressMessage{RunID: "run2", Code: "completed", OverallStatus: "success"})
+	w.progress(b)
+	if status, _ := w.summary(); !finished(w) || status != "success" {
+		t.Fatalf("expected finished with success, got %v", status)
+	}
+}
+
+func Test__formatReport(t *testing.T) {
+	defer func(d string) { dir = d }(dir)
+	dir = "/work"
+	r := ReportPubsub{
+		Scenario:   "/work/services/billing/scenarios/01.yaml",
+		Status:     "error",
+		Data:       "[status code 500]",
+		Attributes: map[string]string{"duration_ms": "1234"},
+	}
+
+	want := "[3/10] FAIL          1.2s  services/billing/scenarios/01.yaml\n    [status code 500]"
+	if got := formatReport(r, 3, 10); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	r = ReportPubsub{Scenario: "/other/01.yaml", Status: "success"}
+	want = "[1] PASS             -  /other/01.yaml"
+	if got := formatReport(r, 1, 0); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+// failingTransport fails to subscribe to any topic.
+type failingTransport struct{ *memTransport }
+
+func (failingTransport) SubscribeTopic(ctx context.Context, topic, group string, ready func(), handler func(data []byte) error) error {
+	return fmt.Errorf("no such topic")
+}
+
+func Test__watchTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := newMemTransport()
+	got := make(chan string, 2)
+	err := watchTopics(ctx, tr, map[string]func(data []byte){
+		"reports":  func(data []byte) { got <- "reports:" + string(data) },
+		"progress": func(data []byte) { got <- "progress:" + string(data) },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, _ := tr.Publisher("progress")
+	pub.Publish("", 1)
+	select {
+	case v := <-got:
+		if v != "progress:1" {
+			t.Fatalf("unexpected message %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no message")
+	}
+
+	err = watchTopics(ctx, failingTransport{tr}, map[string]func(data []byte){"reports": func([]byte) {}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Default wait time for streamed messages (websocket/sse) when no timeout is set.
+const defaultStreamTimeout = time.Second * 10
+
+// MessageAsserts represents acceptance criteria for a single streamed message.
+type MessageAsserts struct {
+	Regex        string `yaml:"regex"`
+	ValidateJSON string `yaml:"validate_json"`
+	MessageOut   string `yaml:"message_out"`
+}
+
+// WebSocketStep is a single entry in a websocket conversation. It can send a
+// message, wait for a matching message, or both (send first, then wait).
+type WebSocketStep struct {
+	Send    string          `yaml:"send"`
+	Expect  *MessageAsserts `yaml:"expect"`
+	Timeout string          `yaml:"timeout"`
+}
+
+// RunWebSocket represents configuration on how to run WebSocket test
+type RunWebSocket struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout string            `yaml:"timeout"`
+	Steps   []WebSocketStep   `yaml:"steps"`
+}
+
+// parseTimeout returns v as a duration, or def if v is empty or invalid.
+func parseTimeout(v string, def time.Duration) time.Duration {
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("invalid timeout %q, using %v", v, def)
+		return def
+	}
+
+	return d
+}
+
+// matchMessage checks msg against the regex and/or JSON schema in a.
+func matchMessage(msg []byte, a *MessageAsserts) error {
+	if a.Regex != "" {
+		re, err := regexp.Compile(a.Regex)
+		if err != nil {
+			return errors.Wrapf(err, "regexp.Compile: %v", a.Regex)
+		}
+
+		if !re.Match(msg) {
+			return fmt.Errorf("message does not match regex %q: %s", a.Regex, msg)
+		}
+	}
+
+	if a.ValidateJSON != "" {
+		err := validateJSON(a.ValidateJSON, gojsonschema.NewBytesLoader(msg))
+		if err != nil {
+			return errors.Wrapf(err, "validate_json: %s", msg)
+		}
+	}
+
+	return nil
+}
+
+// validateJSON validates doc against the JSON schema.
+func validateJSON(schema string, doc gojsonschema.JSONLoader) error {
+	res, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schema), doc)
+	if err != nil {
+		return err
+	}
+
+	if !res.Valid() {
+		var errs []string
+		for _, e := range res.Errors() {
+			errs = append(errs, e.String())
+		}
+
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// runWebSocket executes the websocket step at index i. Failures are appended to s.errs.
+func (s *Scenario) runWebSocket(i int, prefix string, w *RunWebSocket) {
+	fn := fmt.Sprintf("%v_url", prefix)
+	u, err := s.ParseValue(w.URL, fn)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, w.URL))
+		return
+	}
+
+	hdr := http.Header{}
+	for k, v := range w.Headers {
+		fn := fmt.Sprintf("%v_hdr.%v", prefix, k)
+		nv, err := s.ParseValue(v, fn)
+		if err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v]: %v", i, v))
+			continue
+		}
+
+		hdr.Set(k, nv)
+		log.Printf("[header] %v: %v", k, nv)
+	}
+
+	timeout := parseTimeout(w.Timeout, defaultStreamTimeout)
+	ctx, cancel := context.WithTimeout(s.runCtx(), timeout)
+	defer cancel()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u, hdr)
+	if err != nil {
+		s.errs = append(s.errs, errors.Wrapf(err, "websocket.Dial[%v]: %v", i, u))
+		return
+	}
+
+	defer conn.Close()
+	for j, step := range w.Steps {
+		if step.Send != "" {
+			fn := fmt.Sprintf("%v_send%d", prefix, j)
+			nv, err := s.ParseValue(step.Send, fn)
+			if err != nil {
+				s.errs = append(s.errs, errors.Wrapf(err, "ParseValue[%v][%v]: %v", i, j, step.Send))
+				return
+			}
+
+			err = conn.WriteMessage(websocket.TextMessage, []byte(nv))
+			if err != nil {
+				s.errs = append(s.errs, errors.Wrapf(err, "websocket.send[%v][%v]", i, j))
+				return
+			}
+
+			log.Printf("[websocket] send[%v]: %v", j, nv)
+		}
+
+		if step.Expect == nil {
+			continue
+		}
+
+		// A failed read leaves the connection unusable, so we stop here.
+		err := expectWebSocket(conn, step.Expect, parseTimeout(step.Timeout, timeout))
+		if err != nil {
+			s.errs = append(s.errs, errors.Wrapf(err, "websocket.expect[%v][%v]", i, j))
+			return
+		}
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// expectWebSocket reads messages from conn until one matches a, or timeout
+// elapses. Non-matching messages (i.e. heartbeats) are skipped.
+func expectWebSocket(conn *websocket.Conn, a *MessageAsserts, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var last error
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if last != nil {
+				return errors.Wrapf(err, "no matching message within %v, last mismatch: %v", timeout, last)
+			}
+
+			return errors.Wrapf(err, "no matching message within %v", timeout)
+		}
+
+		log.Printf("[websocket] recv: %s", msg)
+		if last = matchMessage(msg, a); last != nil {
+			continue
+		}
+
+		if a.MessageOut != "" {
+			if err := os.WriteFile(a.MessageOut, msg, 0644); err != nil {
+				return errors.Wrapf(err, "write %v", a.MessageOut)
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test__runWebSocket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var up websocket.Upgrader
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","user":"`+r.Header.Get("X-User")+`"}`))
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping"}`))
+			conn.WriteMessage(websocket.TextMessage, msg)
+		}
+	}))
+
+	defer ts.Close()
+	u := "ws" + strings.TrimPrefix(ts.URL, "http")
+	s := Scenario{}
+	s.runWebSocket(0, t.TempDir()+"/ws", &RunWebSocket{
+		URL:     u,
+		Headers: map[string]string{"X-User": "oops"},
+		Steps: []WebSocketStep{
+			{Expect: &MessageAsserts{Regex: `"user":"oops"`}},
+			{
+				Send:   `{"type":"echo","n":1}`,
+				Expect: &MessageAsserts{ValidateJSON: `{"properties":{"type":{"const":"echo"}},"required":["n"]}`},
+			},
+		},
+	})
+
+	if len(s.errs) > 0 {
+		t.Fatal(s.errs)
+	}
+
+	s = Scenario{}
+	s.runWebSocket(0, t.TempDir()+"/ws", &RunWebSocket{
+		URL:     u,
+		Timeout: "200ms",
+		Steps:   []WebSocketStep{{Expect: &MessageAsserts{Regex: "never"}}},
+	})
+
+	if len(s.errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", s.errs)
+	}
+}